@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"deeprefactor/internal/ai"
+	"deeprefactor/internal/checker"
+	"deeprefactor/internal/processor"
+	"deeprefactor/internal/types"
+	"errors"
+	"fmt"
+	"path/filepath"
+)
+
+type ApplyCmd struct {
+	Instruction string   `flag:"" short:"i" required:"" help:"Change to make, e.g. \"replace log.Printf with slog\""`
+	Files       []string `flag:"" sep:"," help:"Glob patterns selecting files, matched against the path relative to --dir or the file name (default: all Go files)"`
+	Check       string   `flag:"" help:"Command template that must succeed for a file to be done (same placeholders as --lint-cmd)"`
+	Pattern     string   `flag:"" help:"Regular expression that must no longer match a file for it to be done"`
+}
+
+// Run applies the instruction with the fix loop. The success checks replace
+// the configured checkers. With --pattern, files it does not match are left
+// alone; with only --check, every file is sent to the model at least once
+// and the check decides when it is done. Autofixers run only when asked
+// for with --autofix.
+func (a *ApplyCmd) Run(cli *CLI) error {
+	if a.Check == "" && a.Pattern == "" {
+		return errors.New("apply needs --check or --pattern to decide when a file is done")
+	}
+	if cli.Batch {
+		return errors.New("--batch is not supported by apply")
+	}
+	if len(cli.Autofix) == 0 {
+		cli.Autofix = []string{"none"}
+	}
+	if err := cli.prepare(); err != nil {
+		return err
+	}
+
+	cli.checkList = nil
+	if a.Pattern != "" {
+		c, err := checker.Parse("pattern:pattern=" + a.Pattern)
+		if err != nil {
+			return err
+		}
+		cli.checkList = append(cli.checkList, c)
+	}
+	if a.Check != "" {
+		cli.checkList = append(cli.checkList, checker.Checker{Name: "check", Cmd: a.Check, Parser: checker.ParseLines, Blocking: true})
+	}
+	if cli.PromptTemplate == "" {
+		cli.prompt = ai.DefaultInstructionTemplate
+	}
+	cli.instruction = a.Instruction
+	cli.instructAll = a.Pattern == ""
+
+	files, err := processor.FindGoFiles(cli.Dir)
+	if err != nil {
+		return fmt.Errorf("error finding Go files: %w", err)
+	}
+	if files, err = selectFiles(cli.Dir, a.Files, files); err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return errors.New("no Go files match --files")
+	}
+
+	return cli.runTUI(files, func(path string) string { return path + ": " + a.Instruction }, cli.processFiles)
+}
+
+// selectFiles keeps the files matching any of the --files patterns.
+func selectFiles(dir string, patterns []string, files []*types.FileProcess) ([]*types.FileProcess, error) {
+	if len(patterns) == 0 {
+		return files, nil
+	}
+	var selected []*types.FileProcess
+	for _, f := range files {
+		rel, err := filepath.Rel(dir, f.Path)
+		if err != nil {
+			rel = f.Path
+		}
+		for _, pattern := range patterns {
+			relMatch, err := filepath.Match(pattern, filepath.ToSlash(rel))
+			if err != nil {
+				return nil, fmt.Errorf("bad --files pattern %q: %w", pattern, err)
+			}
+			baseMatch, _ := filepath.Match(pattern, filepath.Base(f.Path))
+			if relMatch || baseMatch {
+				selected = append(selected, f)
+				break
+			}
+		}
+	}
+	return selected, nil
+}
@@ -0,0 +1,289 @@
+package cmd
+
+import (
+	"context"
+	"deeprefactor/internal/ai"
+	"deeprefactor/internal/checker"
+	"deeprefactor/internal/processor"
+	"deeprefactor/internal/types"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// processPackage lints all files of the package in dir with a single run of
+// the checkers or the package lint command, fixes the files that have
+// diagnostics in parallel and re-lints the package after each batch of
+// edits.
+func (cli *CLI) processPackage(dir string, files []*types.FileProcess, updates chan<- types.FileUpdate) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Duration(len(files))*time.Minute)
+	defer cancel()
+
+	for _, file := range files {
+		if original, err := os.ReadFile(file.Path); err == nil {
+			file.Mutex.Lock()
+			file.Original = string(original)
+			file.Mutex.Unlock()
+		}
+	}
+	if cli.Verify {
+		cli.takeBaseline(ctx, files[0].Path, updates)
+	}
+
+	pending := files
+	// fixes holds the AI fixes of every file since the package last passed
+	// verification, oldest first, so that they can be reverted together;
+	// awaiting holds the files that pass lint but wait for it.
+	fixes := make(map[*types.FileProcess][]ai.Edit)
+	awaiting := make(map[*types.FileProcess]bool)
+	// Files edited during their fix are left to the developer.
+	var conflictsMu sync.Mutex
+	conflicts := make(map[*types.FileProcess]bool)
+	conflict := func(file *types.FileProcess, err error) {
+		conflictsMu.Lock()
+		conflicts[file] = true
+		conflictsMu.Unlock()
+		updates <- types.FileUpdate{Path: file.Path, Status: "Conflict", Log: err.Error()}
+	}
+	for attempt := 1; attempt <= cli.MaxRetries; attempt++ {
+		for _, file := range pending {
+			updates <- types.FileUpdate{
+				Path:   file.Path,
+				Status: fmt.Sprintf("Attempt %d/%d", attempt, cli.MaxRetries),
+			}
+		}
+
+		output, diags, err := cli.lintPackage(ctx, dir)
+		if err != nil && cli.autofixPackage(ctx, dir, files, diags, updates, conflict) {
+			output, diags, err = cli.lintPackage(ctx, dir)
+		}
+		byFile := splitDiagnostics(dir, files, diags)
+		if err != nil && len(byFile) == 0 {
+			// The linter failed without reporting anything we can attribute
+			// to a file, so every file gets the full output.
+			for _, file := range files {
+				byFile[file] = nil
+			}
+		}
+
+		wasPending := make(map[*types.FileProcess]bool)
+		for _, file := range pending {
+			wasPending[file] = true
+		}
+		pending = nil
+		for _, file := range files {
+			if conflicts[file] {
+				continue
+			}
+			diags, failing := byFile[file]
+			if !failing {
+				switch {
+				case !wasPending[file]:
+				case cli.Verify && len(fixes[file]) > 0:
+					awaiting[file] = true
+					updates <- types.FileUpdate{Path: file.Path, Status: "Verifying", Log: "Package lint passed for this file, waiting for the package to build and test", Diagnostics: []types.Diagnostic{}}
+				default:
+					updates <- types.FileUpdate{Path: file.Path, Status: "Fixed", Log: "Package lint passed for this file", Diagnostics: []types.Diagnostic{}}
+				}
+				continue
+			}
+			if diags == nil {
+				diags = []types.Diagnostic{}
+			}
+			update := types.FileUpdate{
+				Path:        file.Path,
+				Log:         fmt.Sprintf("Lint errors:\n%s", fileOutput(diags, output)),
+				Diagnostics: diags,
+			}
+			if !wasPending[file] {
+				// An edit to another file broke this one again.
+				update.Status = fmt.Sprintf("Attempt %d/%d", attempt, cli.MaxRetries)
+				delete(awaiting, file)
+			}
+			updates <- update
+			pending = append(pending, file)
+		}
+		if len(pending) == 0 && len(awaiting) > 0 {
+			verr := cli.verifyBatch(ctx, dir, fixes, awaiting, updates, conflict)
+			fixes = make(map[*types.FileProcess][]ai.Edit)
+			if verr == nil {
+				awaiting = nil
+				break
+			}
+			// The fixes were reverted, so their files start over.
+			for file := range awaiting {
+				if !conflicts[file] {
+					pending = append(pending, file)
+				}
+			}
+			awaiting = make(map[*types.FileProcess]bool)
+			continue
+		}
+		if len(pending) == 0 {
+			break
+		}
+
+		if cli.usage.Exhausted(cli.TokenBudget) {
+			for _, file := range pending {
+				updates <- types.FileUpdate{Path: file.Path, Status: "Skipped", Log: fmt.Sprintf("Token budget of %d exhausted", cli.TokenBudget)}
+			}
+			pending = nil
+			break
+		}
+
+		var fixesMu sync.Mutex
+		var wg sync.WaitGroup
+		for _, file := range pending {
+			wg.Add(1)
+			go func(file *types.FileProcess) {
+				defer wg.Done()
+				edit, err := cli.fixFile(ctx, file.Path, fileOutput(byFile[file], output), byFile[file], updates)
+				switch {
+				case errors.Is(err, ai.ErrConflict):
+					conflict(file, err)
+				case err != nil:
+					updates <- types.FileUpdate{Path: file.Path, Log: fmt.Sprintf("Fix error: %v", err)}
+				default:
+					fixesMu.Lock()
+					fixes[file] = append(fixes[file], edit)
+					fixesMu.Unlock()
+				}
+			}(file)
+		}
+		wg.Wait()
+	}
+
+	for _, file := range pending {
+		updates <- types.FileUpdate{Path: file.Path, Status: "Failed"}
+	}
+	// Files that pass lint while others ran out of attempts are still
+	// verified before they count as fixed.
+	if len(awaiting) > 0 && cli.verifyBatch(ctx, dir, fixes, awaiting, updates, conflict) != nil {
+		for file := range awaiting {
+			if !conflicts[file] {
+				updates <- types.FileUpdate{Path: file.Path, Status: "Failed"}
+			}
+		}
+	}
+}
+
+// lintPackage runs the blocking --checker list on the package in dir, or
+// --package-lint-cmd without one, and returns the output, the diagnostics
+// and an error if the package fails.
+func (cli *CLI) lintPackage(ctx context.Context, dir string) (string, []types.Diagnostic, error) {
+	if len(cli.Checkers) == 0 {
+		output, err := processor.RunLintCommand(ctx, cli.PackageLintCmd, dir, cli.Shell)
+		return output, processor.ParseDiagnostics(output), err
+	}
+	failed := checker.Blocking(checker.RunAll(ctx, cli.checkList, dir, cli.Shell))
+	var diags []types.Diagnostic
+	for _, r := range failed {
+		diags = append(diags, r.Diagnostics...)
+	}
+	if len(failed) > 0 {
+		return checker.Format(failed), diags, fmt.Errorf("failing: %s", checker.Names(failed))
+	}
+	return "", nil, nil
+}
+
+// autofixPackage applies the mechanical fixers to the files with
+// diagnostics and reports whether any of them changed. Files whose fixes
+// overlap concurrent edits are passed to conflict.
+func (cli *CLI) autofixPackage(ctx context.Context, dir string, files []*types.FileProcess, diags []types.Diagnostic, updates chan<- types.FileUpdate, conflict func(*types.FileProcess, error)) bool {
+	changed := false
+	for file := range splitDiagnostics(dir, files, diags) {
+		applied, err := cli.applyAutofixes(ctx, file.Path, updates)
+		if err != nil {
+			conflict(file, err)
+		}
+		if applied {
+			changed = true
+		}
+	}
+	return changed
+}
+
+// verifyBatch builds and tests the package in dir and marks the awaiting
+// files fixed unless that adds failures to the baseline. Otherwise every fix
+// since the last verification is reverted, newest first and keeping edits
+// made to the files since, and the error is returned. Files whose fixes
+// cannot be reverted that way are passed to conflict.
+func (cli *CLI) verifyBatch(ctx context.Context, dir string, fixes map[*types.FileProcess][]ai.Edit, awaiting map[*types.FileProcess]bool, updates chan<- types.FileUpdate, conflict func(*types.FileProcess, error)) error {
+	g := cli.gate(dir)
+	g.Lock()
+	defer g.Unlock()
+	result, output, err := cli.runVerification(ctx, dir)
+	if len(result.added(g.baseline)) == 0 {
+		for file := range awaiting {
+			updates <- types.FileUpdate{Path: file.Path, Status: "Fixed", Log: "Build and tests passed"}
+		}
+		return nil
+	}
+	for file, edits := range fixes {
+		reverted, kept := true, false
+		for i := len(edits) - 1; i >= 0 && reverted; i-- {
+			merged, werr := edits[i].Revert(cli.backup)
+			switch {
+			case errors.Is(werr, ai.ErrConflict):
+				conflict(file, werr)
+				reverted = false
+			case werr != nil:
+				updates <- types.FileUpdate{Path: file.Path, Log: fmt.Sprintf("Rollback failed: %v", werr)}
+				reverted = false
+			case merged:
+				kept = true
+			}
+		}
+		if reverted && kept {
+			updates <- types.FileUpdate{Path: file.Path, Log: "The file changed after the fixes, kept those changes while rolling them back"}
+		}
+		if reverted {
+			updates <- types.FileUpdate{Path: file.Path, Log: fmt.Sprintf("Package verification failed, rolled back the fixes: %v\n%s", err, output)}
+		}
+	}
+	return err
+}
+
+// splitDiagnostics assigns the diagnostics of a package to the files they
+// refer to. Relative paths may be relative to the working directory or to
+// the package directory. Files without diagnostics are absent from the map.
+func splitDiagnostics(dir string, files []*types.FileProcess, diags []types.Diagnostic) map[*types.FileProcess][]types.Diagnostic {
+	byFile := make(map[*types.FileProcess][]types.Diagnostic)
+	for _, d := range diags {
+		for _, file := range files {
+			if processor.SameFile(d.File, file.Path) ||
+				(!filepath.IsAbs(d.File) && processor.SameFile(filepath.Join(dir, d.File), file.Path)) {
+				byFile[file] = append(byFile[file], d)
+				break
+			}
+		}
+	}
+	return byFile
+}
+
+func fileOutput(diags []types.Diagnostic, fallback string) string {
+	if len(diags) == 0 {
+		return fallback
+	}
+	lines := make([]string, len(diags))
+	for i, d := range diags {
+		lines[i] = d.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+func groupByPackage(items []types.TableItem) map[string][]*types.FileProcess {
+	packages := make(map[string][]*types.FileProcess)
+	for _, item := range items {
+		if item.Type != "file" {
+			continue
+		}
+		dir := filepath.Dir(item.File.Path)
+		packages[dir] = append(packages[dir], item.File)
+	}
+	return packages
+}
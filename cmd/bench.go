@@ -0,0 +1,235 @@
+package cmd
+
+import (
+	"deeprefactor/internal/ai"
+	"deeprefactor/internal/processor"
+	"deeprefactor/internal/types"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+type BenchCmd struct {
+	Corpus  string   `arg:"" type:"existingdir" help:"Directory of broken Go files to fix, e.g. testdata"`
+	Models  []string `flag:"" sep:"," help:"Models to compare (default: --model)"`
+	Prompts []string `flag:"" sep:"," type:"existingfile" help:"Prompt template files to compare (default: built-in prompt)"`
+	Format  string   `flag:"" enum:"table,csv" default:"table" help:"Output format (table, csv)"`
+	Output  string   `flag:"" short:"o" help:"Write results to a file instead of stdout"`
+	Keep    bool     `flag:"" help:"Keep the working copies of the corpus for inspection"`
+}
+
+type benchResult struct {
+	Model    string
+	Prompt   string
+	Files    int
+	Passed   int
+	Attempts int
+	Compiles int
+	Usage    types.Usage
+	Wall     time.Duration
+}
+
+func (b *BenchCmd) Run(cli *CLI) error {
+	// The corpus is copied to temporary directories, so there is nothing
+	// to undo.
+	cli.Backup = false
+	if err := cli.prepare(); err != nil {
+		return err
+	}
+	models := b.Models
+	if len(models) == 0 {
+		models = []string{cli.Model}
+	}
+	prompts := map[string]string{"default": ai.DefaultPromptTemplate}
+	promptNames := []string{"default"}
+	if len(b.Prompts) > 0 {
+		prompts = make(map[string]string)
+		promptNames = nil
+		for _, p := range b.Prompts {
+			content, err := os.ReadFile(p)
+			if err != nil {
+				return fmt.Errorf("read prompt template: %w", err)
+			}
+			prompts[p] = string(content)
+			promptNames = append(promptNames, p)
+		}
+	}
+
+	var results []benchResult
+	for _, model := range models {
+		for _, name := range promptNames {
+			fmt.Fprintf(cli.output(), "Running %s with prompt %s...\n", model, name)
+			res, err := b.runOne(cli, model, name, prompts[name])
+			if err != nil {
+				return err
+			}
+			results = append(results, res)
+		}
+	}
+
+	out := cli.output()
+	if b.Output != "" {
+		f, err := os.Create(b.Output)
+		if err != nil {
+			return fmt.Errorf("create output: %w", err)
+		}
+		defer f.Close()
+		out = f
+	}
+	if b.Format == "csv" {
+		return writeBenchCSV(out, results)
+	}
+	writeBenchTable(out, results)
+	return nil
+}
+
+func (b *BenchCmd) runOne(cli *CLI, model, promptName, prompt string) (benchResult, error) {
+	work, err := os.MkdirTemp("", "deeprefactor-bench-*")
+	if err != nil {
+		return benchResult{}, err
+	}
+	if b.Keep {
+		fmt.Fprintf(cli.output(), "Working copy: %s\n", work)
+	} else {
+		defer os.RemoveAll(work)
+	}
+	if err := copyDir(b.Corpus, work); err != nil {
+		return benchResult{}, fmt.Errorf("copy corpus: %w", err)
+	}
+	files, err := processor.FindGoFiles(work)
+	if err != nil {
+		return benchResult{}, fmt.Errorf("error finding Go files: %w", err)
+	}
+
+	run := *cli
+	run.Model = model
+	run.prompt = prompt
+	run.usage = newUsageTracker()
+
+	updates := make(chan types.FileUpdate, 100)
+	go func() {
+		for range updates {
+		}
+	}()
+
+	res := benchResult{Model: model, Prompt: promptName, Files: len(files)}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	start := time.Now()
+	for _, f := range files {
+		wg.Add(1)
+		go func(file *types.FileProcess) {
+			defer wg.Done()
+			status, attempts := run.processFile(file, updates)
+			mu.Lock()
+			defer mu.Unlock()
+			if status == "Fixed" {
+				res.Passed++
+				res.Attempts += attempts
+			}
+		}(f)
+	}
+	wg.Wait()
+	close(updates)
+	res.Wall = time.Since(start)
+	res.Usage = run.usage.Total()
+
+	broken := make(map[string]bool)
+	checked := make(map[string]bool)
+	for _, f := range files {
+		dir := filepath.Dir(f.Path)
+		if checked[dir] {
+			continue
+		}
+		checked[dir] = true
+		diags, err := processor.TypeCheck(dir)
+		if err != nil {
+			return res, fmt.Errorf("type check %s: %w", dir, err)
+		}
+		for _, d := range diags {
+			broken[filepath.Clean(d.File)] = true
+		}
+	}
+	for _, f := range files {
+		if !broken[filepath.Clean(f.Path)] {
+			res.Compiles++
+		}
+	}
+	return res, nil
+}
+
+func (r benchResult) passRate() float64 {
+	if r.Files == 0 {
+		return 0
+	}
+	return float64(r.Passed) / float64(r.Files)
+}
+
+func (r benchResult) avgAttempts() float64 {
+	if r.Passed == 0 {
+		return 0
+	}
+	return float64(r.Attempts) / float64(r.Passed)
+}
+
+func writeBenchTable(w io.Writer, results []benchResult) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "Model\tPrompt\tPassed\tPass rate\tAvg attempts\tTokens\tWall time\tCompiles\t")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%d/%d\t%.0f%%\t%.1f\t%d\t%.1fs\t%d/%d\t\n",
+			r.Model, r.Prompt, r.Passed, r.Files, r.passRate()*100, r.avgAttempts(),
+			r.Usage.Tokens(), r.Wall.Seconds(), r.Compiles, r.Files)
+	}
+	tw.Flush()
+}
+
+func writeBenchCSV(w io.Writer, results []benchResult) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"model", "prompt", "files", "passed", "pass_rate", "avg_attempts",
+		"prompt_tokens", "completion_tokens", "model_seconds", "wall_seconds", "compiles"})
+	for _, r := range results {
+		cw.Write([]string{
+			r.Model,
+			r.Prompt,
+			strconv.Itoa(r.Files),
+			strconv.Itoa(r.Passed),
+			strconv.FormatFloat(r.passRate(), 'f', 3, 64),
+			strconv.FormatFloat(r.avgAttempts(), 'f', 2, 64),
+			strconv.Itoa(r.Usage.PromptTokens),
+			strconv.Itoa(r.Usage.CompletionTokens),
+			strconv.FormatFloat(r.Usage.Duration.Seconds(), 'f', 2, 64),
+			strconv.FormatFloat(r.Wall.Seconds(), 'f', 2, 64),
+			strconv.Itoa(r.Compiles),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func copyDir(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(target, content, 0644)
+	})
+}
@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"deeprefactor/internal/annotate"
+	"deeprefactor/internal/processor"
+	"deeprefactor/pkg/utils"
+	"fmt"
+	"os"
+)
+
+type CleanCmd struct {
+	Paths  []string `arg:"" optional:"" type:"path" help:"Files or directories to clean (default: --dir)"`
+	DryRun bool     `flag:"" help:"Only report the markers that would be removed"`
+}
+
+// Run removes [DeepRefactor] comments left by earlier runs. Files that do
+// not parse are reported and left alone.
+func (c *CleanCmd) Run(cli *CLI) error {
+	paths := c.Paths
+	if len(paths) == 0 {
+		paths = []string{cli.Dir}
+	}
+	out := cli.output()
+
+	total, changed := 0, 0
+	for _, root := range paths {
+		files, err := processor.FindGoFiles(root)
+		if err != nil {
+			return fmt.Errorf("error finding Go files: %w", err)
+		}
+		for _, f := range files {
+			src, err := os.ReadFile(f.Path)
+			if err != nil {
+				return err
+			}
+			cleaned, removed, err := annotate.Strip(src)
+			if err != nil {
+				fmt.Fprintf(out, "%s: skipped: %v\n", f.Path, err)
+				continue
+			}
+			if len(removed) == 0 {
+				continue
+			}
+			if !c.DryRun {
+				if err := utils.SafeWriteFile(f.Path, string(cleaned)); err != nil {
+					return err
+				}
+			}
+			fmt.Fprintf(out, "%s: removed %d markers\n", f.Path, len(removed))
+			total += len(removed)
+			changed++
+		}
+	}
+
+	verb := "Removed"
+	if c.DryRun {
+		verb = "Would remove"
+	}
+	fmt.Fprintf(out, "%s %d markers from %d files\n", verb, total, changed)
+	return nil
+}
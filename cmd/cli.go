@@ -3,77 +3,421 @@ package cmd
 import (
 	"context"
 	"deeprefactor/internal/ai"
+	"deeprefactor/internal/autofix"
+	"deeprefactor/internal/backup"
+	"deeprefactor/internal/checker"
+	"deeprefactor/internal/driver"
+	"deeprefactor/internal/knowledge"
 	"deeprefactor/internal/processor"
 	"deeprefactor/internal/tui"
 	"deeprefactor/internal/types"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 )
 
 type CLI struct {
-	Dir        string `flag:"" default:"." help:"Directory to search for Go files"`
-	MaxRetries int    `flag:"" default:"5" help:"Maximum fix attempts per file"`
-	OllamaURL  string `flag:"" default:"http://localhost:11434" help:"Ollama server URL"`
-	Model      string `flag:"" default:"deepseek-coder-v2" help:"Ollama model to use"`
-	LintCmd    string `flag:"" default:"golangci-lint run {{filepath}}" help:"Lint command template (use {{filepath}})"`
+	Dir            string   `flag:"" default:"." help:"Directory to search for Go files"`
+	MaxRetries     int      `flag:"" default:"5" help:"Maximum fix attempts per file"`
+	OllamaURL      string   `flag:"" default:"http://localhost:11434" help:"Ollama server URL"`
+	Model          string   `flag:"" default:"deepseek-coder-v2" help:"Ollama model to use"`
+	LintCmd        string   `flag:"" default:"golangci-lint run {{filepath}}" help:"Lint command template (placeholders: {{filepath}}, {{dir}}, {{package}}, {{module}}, {{relpath}})"`
+	Shell          bool     `flag:"" help:"Run lint commands through sh -c so pipes, redirects and variables work"`
+	Checkers       []string `flag:"" name:"checker" sep:"none" placeholder:"NAME[:PARSER][?][=CMD]" help:"Ordered checker to run instead of --lint-cmd; repeatable. Presets: gofmt, vet, staticcheck, golangci-lint, analysis (in-process, e.g. analysis=vet,nilness). A trailing ? makes it advisory."`
+	AnalyzerConfig string   `flag:"" type:"existingfile" help:"JSON file listing analyzer plugins, the analyzers of the custom suite and their prompt hints"`
+	Knowledge      []string `flag:"" type:"path" help:"JSON files or directories of fixing guidelines added to the built-in knowledge base (.deeprefactor/knowledge in --dir is loaded automatically)"`
+	Autofix        []string `flag:"" help:"Mechanical fixers applied before asking the model (gofmt, goimports, golangci-lint, analysis, none); goimports by default, none for apply"`
+	TokenBudget    int      `flag:"" default:"0" help:"Stop sending requests once this many tokens are used (0 = unlimited)"`
+	PromptTemplate string   `flag:"" type:"existingfile" help:"File with a Go text/template for the fix prompt (fields: .Path, .Errors, .Content, .Guidelines, .Instruction, .Source)"`
+
+	Batch          bool   `flag:"" help:"Lint each package once per attempt and fix only the files with diagnostics"`
+	PackageLintCmd string `flag:"" default:"golangci-lint run {{dir}}" help:"Lint command template used with --batch when no --checker is given (use {{dir}})"`
+
+	Verify        bool          `flag:"" help:"Build and test the package after lint passes and roll back fixes that add failures it did not have before the run"`
+	VerifyRun     string        `flag:"" help:"Only run tests matching this regexp during verification"`
+	VerifyTimeout time.Duration `flag:"" default:"2m" help:"Timeout for the verification build and tests"`
+
+	Headless bool   `flag:"" help:"Print progress as plain text instead of the interactive UI and fail if any file is not fixed"`
+	Backup   bool   `flag:"" default:"true" negatable:"" help:"Save the original of every changed file under .deeprefactor/backups in --dir for undo"`
+	Annotate string `flag:"" enum:"none,inline,summary" default:"inline" help:"How the model marks its changes with [DeepRefactor] comments (none, inline, summary)"`
+	Record   string `flag:"" type:"path" xor:"replay" help:"Save every model request and response as JSON files in this directory"`
+	Replay   string `flag:"" type:"existingdir" xor:"replay" help:"Answer model requests from a recording made with --record instead of the network"`
+
+	Fix   FixCmd   `cmd:"" default:"1" help:"Fix lint errors in --dir (default command)"`
+	Bench BenchCmd `cmd:"" help:"Compare models and prompt templates on a corpus of broken files"`
+	Apply ApplyCmd `cmd:"" help:"Apply a natural-language refactoring instruction to the files in --dir"`
+	Tests TestsCmd `cmd:"" help:"Generate tests for functions without coverage in --dir"`
+	Clean CleanCmd `cmd:"" help:"Remove [DeepRefactor] comments from the files in --dir"`
+	Undo  UndoCmd  `cmd:"" help:"Restore the files changed by a run from its backup"`
+	Watch WatchCmd `cmd:"" help:"Keep running and fix Go files in --dir as they are saved"`
+	Lsp   LspCmd   `cmd:"" help:"Serve diagnostics and fix code actions over the Language Server Protocol on stdio"`
+	Serve ServeCmd `cmd:"" help:"Serve an HTTP/JSON API for submitting fix jobs and following them"`
+
+	usage     *usageTracker
+	prompt    string
+	checkList []checker.Checker
+	fixers    []autofix.Fixer
+	knowledge *knowledge.Base
+	// instruction replaces lint output as the task in apply mode.
+	instruction string
+	// instructAll has every file sent to the model at least once, even if
+	// it passes the checks already.
+	instructAll bool
+	// stdout replaces os.Stdout in tests.
+	stdout io.Writer
+	// httpClient records or replays model requests, or is nil.
+	httpClient *http.Client
+	// backup holds the originals of the files changed by this run, or is
+	// nil with --no-backup.
+	backup *backup.Run
+	// gates orders fixes and verification per package with --verify.
+	gates *packageGates
+	// confirm receives the files the user agreed to fix in the UI, for
+	// commands that ask first.
+	confirm func(path string)
 }
 
-func (cli *CLI) Run() error {
+type FixCmd struct{}
+
+func (f *FixCmd) Run(cli *CLI) error {
+	if err := cli.prepare(); err != nil {
+		return err
+	}
+
 	files, err := processor.FindGoFiles(cli.Dir)
 	if err != nil {
 		return fmt.Errorf("error finding Go files: %w", err)
 	}
 
+	return cli.runTUI(files, cli.lintTitle, cli.processFiles)
+}
+
+// lintTitle is the lint command of path, with its placeholders expanded.
+func (cli *CLI) lintTitle(path string) string {
+	return processor.ExpandPlaceholders(cli.LintCmd, path)
+}
+
+// runTUI runs process in the background of the interactive UI, or of the
+// plain output with --headless, and prints the usage summary once it
+// exits. The title of the selected file is shown above its log.
+func (cli *CLI) runTUI(files []*types.FileProcess, title func(path string) string, process func(chan<- types.FileUpdate, []types.TableItem)) error {
+	cli.usage = newUsageTracker()
+	if cli.Headless {
+		err := cli.runHeadless(files, process)
+		cli.finishBackup()
+		return err
+	}
 	tui.Create(files, func(updates chan<- types.FileUpdate, items []types.TableItem) {
-		go cli.processFiles(updates, items)
-	}, cli.LintCmd)
+		go process(updates, items)
+	}, title, cli.MaxRetries, cli.confirm)
+
+	cli.usage.WriteSummary(cli.output())
+	cli.finishBackup()
+	return nil
+}
+
+// finishBackup completes the backup of the run and tells how to undo it.
+func (cli *CLI) finishBackup() {
+	if err := cli.backup.Finish(); err != nil {
+		fmt.Fprintf(cli.output(), "Backup error: %v\n", err)
+		return
+	}
+	if n := cli.backup.Len(); n > 0 {
+		fmt.Fprintf(cli.output(), "Backed up %d files as run %s; undo with: deeprefactor undo %s\n", n, cli.backup.ID(), cli.backup.ID())
+	}
+}
+
+// output is where commands print their results.
+func (cli *CLI) output() io.Writer {
+	if cli.stdout != nil {
+		return cli.stdout
+	}
+	return os.Stdout
+}
+
+// prepare loads the configuration shared by every command that runs the
+// fix loop.
+func (cli *CLI) prepare() error {
+	if err := cli.loadPrompt(); err != nil {
+		return err
+	}
+	if cli.AnalyzerConfig != "" {
+		if err := driver.LoadConfig(cli.AnalyzerConfig); err != nil {
+			return err
+		}
+	}
+	if err := cli.loadCheckers(); err != nil {
+		return err
+	}
+	if len(cli.Autofix) == 0 {
+		cli.Autofix = []string{"goimports"}
+	}
+	fixers, err := autofix.Lookup(cli.Autofix)
+	if err != nil {
+		return err
+	}
+	cli.fixers = fixers
+	cli.gates = newPackageGates()
+	if err := cli.loadTransport(); err != nil {
+		return err
+	}
+	if cli.Backup {
+		run, err := backup.NewRun(cli.Dir)
+		if err != nil {
+			return err
+		}
+		cli.backup = run
+	}
+	return cli.loadKnowledge()
+}
+
+// loadTransport sets up --record and --replay.
+func (cli *CLI) loadTransport() error {
+	switch {
+	case cli.Record != "":
+		rec, err := ai.NewRecorder(cli.Record, nil)
+		if err != nil {
+			return err
+		}
+		cli.httpClient = &http.Client{Transport: rec}
+	case cli.Replay != "":
+		rep, err := ai.NewReplayer(cli.Replay)
+		if err != nil {
+			return err
+		}
+		cli.httpClient = &http.Client{Transport: rep}
+	}
+	return nil
+}
+
+// loadKnowledge builds the knowledge base from the built-in rules, the
+// repository's .deeprefactor/knowledge directory and --knowledge.
+func (cli *CLI) loadKnowledge() error {
+	cli.knowledge = knowledge.Default()
+	paths := cli.Knowledge
+	repoDir := filepath.Join(cli.Dir, ".deeprefactor", "knowledge")
+	if _, err := os.Stat(repoDir); err == nil {
+		paths = append([]string{repoDir}, paths...)
+	}
+	for _, p := range paths {
+		if err := cli.knowledge.Load(p); err != nil {
+			return fmt.Errorf("load knowledge base: %w", err)
+		}
+	}
+	return nil
+}
+
+func (cli *CLI) loadPrompt() error {
+	cli.prompt = ai.DefaultPromptTemplate
+	if cli.PromptTemplate == "" {
+		return nil
+	}
+	content, err := os.ReadFile(cli.PromptTemplate)
+	if err != nil {
+		return fmt.Errorf("read prompt template: %w", err)
+	}
+	cli.prompt = string(content)
+	return nil
+}
+
+// loadCheckers parses the --checker flags. Without any, the single
+// --lint-cmd is used.
+func (cli *CLI) loadCheckers() error {
+	if len(cli.Checkers) == 0 {
+		cli.checkList = []checker.Checker{{Name: "lint", Cmd: cli.LintCmd, Parser: checker.ParseLines, Blocking: true}}
+		return nil
+	}
+	cli.checkList = nil
+	for _, spec := range cli.Checkers {
+		c, err := checker.Parse(spec)
+		if err != nil {
+			return err
+		}
+		cli.checkList = append(cli.checkList, c)
+	}
 	return nil
 }
 
 func (cli *CLI) processFiles(updates chan<- types.FileUpdate, items []types.TableItem) {
 	var wg sync.WaitGroup
 
-	for _, item := range items {
-		if item.Type != "file" {
-			continue
+	if cli.Batch {
+		for dir, files := range groupByPackage(items) {
+			wg.Add(1)
+			go func(dir string, files []*types.FileProcess) {
+				defer wg.Done()
+				cli.processPackage(dir, files, updates)
+			}(dir, files)
 		}
-		wg.Add(1)
-		go func(file *types.FileProcess) {
-			defer wg.Done()
-			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
-			defer cancel()
-
-			for attempt := 1; attempt <= cli.MaxRetries; attempt++ {
-				updates <- types.FileUpdate{
-					Path:   file.Path,
-					Status: fmt.Sprintf("Attempt %d/%d", attempt, cli.MaxRetries),
-				}
+	} else {
+		for _, item := range items {
+			if item.Type != "file" {
+				continue
+			}
+			wg.Add(1)
+			go func(file *types.FileProcess) {
+				defer wg.Done()
+				cli.processFile(file, updates)
+			}(item.File)
+		}
+	}
 
-				lintCmd := strings.Replace(cli.LintCmd, "{{filepath}}", file.Path, 1)
-				output, err := processor.RunLintCommand(ctx, lintCmd)
-				if err == nil {
-					updates <- types.FileUpdate{Path: file.Path, Status: "Fixed", Log: "Lint passed"}
-					return
-				}
+	wg.Wait()
+	close(updates)
+}
 
-				updates <- types.FileUpdate{Path: file.Path, Log: fmt.Sprintf("Lint errors:\n%s", output)}
-				if err := cli.fixFile(ctx, file.Path, output, updates); err != nil {
-					updates <- types.FileUpdate{Path: file.Path, Log: fmt.Sprintf("Fix error: %v", err)}
+// processFile runs the lint and fix loop for a single file. It returns the
+// final status and the number of attempts used.
+func (cli *CLI) processFile(file *types.FileProcess, updates chan<- types.FileUpdate) (string, int) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	if original, err := os.ReadFile(file.Path); err == nil {
+		file.Mutex.Lock()
+		file.Original = string(original)
+		file.Mutex.Unlock()
+	}
+	if cli.Verify {
+		cli.takeBaseline(ctx, file.Path, updates)
+	}
+
+	// fix holds the most recent AI fix so that it can be rolled back if
+	// it fails verification.
+	var fix *ai.Edit
+	for attempt := 1; attempt <= cli.MaxRetries; attempt++ {
+		updates <- types.FileUpdate{
+			Path:   file.Path,
+			Status: fmt.Sprintf("Attempt %d/%d", attempt, cli.MaxRetries),
+		}
+
+		results := checker.RunAll(ctx, cli.checkList, file.Path, cli.Shell)
+		failed := checker.Blocking(results)
+		if len(failed) > 0 {
+			applied, err := cli.applyAutofixes(ctx, file.Path, updates)
+			if err != nil {
+				updates <- types.FileUpdate{Path: file.Path, Status: "Conflict", Log: err.Error()}
+				return "Conflict", attempt
+			}
+			if applied {
+				results = checker.RunAll(ctx, cli.checkList, file.Path, cli.Shell)
+				failed = checker.Blocking(results)
+			}
+		}
+		output := checker.Format(results)
+		if len(failed) == 0 && (!cli.instructAll || fix != nil) {
+			msg := "Lint passed"
+			if output != "" {
+				msg += "; advisory findings:\n" + output
+			}
+			updates <- types.FileUpdate{Path: file.Path, Log: msg, Diagnostics: diagnosticsFor(file.Path, results)}
+			if cli.Verify && fix != nil {
+				if err := cli.verify(ctx, *fix, updates); err != nil {
+					if errors.Is(err, ai.ErrConflict) {
+						updates <- types.FileUpdate{Path: file.Path, Status: "Conflict", Log: err.Error()}
+						return "Conflict", attempt
+					}
+					updates <- types.FileUpdate{Path: file.Path, Log: err.Error()}
+					fix = nil
+					continue
 				}
 			}
-			updates <- types.FileUpdate{Path: file.Path, Status: "Failed"}
-		}(item.File)
+			updates <- types.FileUpdate{Path: file.Path, Status: "Fixed"}
+			return "Fixed", attempt
+		}
+
+		if len(failed) > 0 {
+			updates <- types.FileUpdate{
+				Path:        file.Path,
+				Status:      "Failing: " + checker.Names(failed),
+				Log:         fmt.Sprintf("Lint errors:\n%s", output),
+				Diagnostics: diagnosticsFor(file.Path, results),
+			}
+		}
+		if cli.usage.Exhausted(cli.TokenBudget) {
+			updates <- types.FileUpdate{Path: file.Path, Status: "Skipped", Log: fmt.Sprintf("Token budget of %d exhausted", cli.TokenBudget)}
+			return "Skipped", attempt
+		}
+		edit, err := cli.fixFile(ctx, file.Path, output, diagnosticsFor(file.Path, results), updates)
+		if err != nil {
+			if errors.Is(err, ai.ErrConflict) {
+				updates <- types.FileUpdate{Path: file.Path, Status: "Conflict", Log: err.Error()}
+				return "Conflict", attempt
+			}
+			updates <- types.FileUpdate{Path: file.Path, Log: fmt.Sprintf("Fix error: %v", err)}
+			continue
+		}
+		fix = &edit
 	}
+	updates <- types.FileUpdate{Path: file.Path, Status: "Failed"}
+	return "Failed", cli.MaxRetries
+}
 
-	wg.Wait()
-	close(updates)
+// applyAutofixes runs the mechanical fixers on path and reports whether any
+// of them changed it. The only error returned is ai.ErrConflict, when a fix
+// overlaps edits made to the file meanwhile; other failures are logged.
+func (cli *CLI) applyAutofixes(ctx context.Context, path string, updates chan<- types.FileUpdate) (bool, error) {
+	if len(cli.fixers) == 0 {
+		return false, nil
+	}
+	if cli.Verify {
+		g := cli.gate(filepath.Dir(path))
+		g.RLock()
+		defer g.RUnlock()
+	}
+	applied, err := autofix.Run(ctx, cli.fixers, path, cli.backup)
+	if errors.Is(err, ai.ErrConflict) {
+		return false, err
+	}
+	if err != nil {
+		updates <- types.FileUpdate{Path: path, Log: fmt.Sprintf("Autofix error: %v", err)}
+	}
+	if len(applied) == 0 {
+		return false, nil
+	}
+	updates <- types.FileUpdate{Path: path, Log: fmt.Sprintf("Applied %s, re-checking", strings.Join(applied, ", "))}
+	return true, nil
+}
+
+func diagnosticsFor(path string, results []checker.Result) []types.Diagnostic {
+	diags := []types.Diagnostic{}
+	for _, r := range results {
+		for _, d := range r.Diagnostics {
+			if processor.SameFile(d.File, path) {
+				diags = append(diags, d)
+			}
+		}
+	}
+	return diags
 }
 
-func (cli *CLI) fixFile(ctx context.Context, path string, lintOutput string, updates chan<- types.FileUpdate) error {
+// newClient returns a model client configured with the prompt template and
+// instruction of the current command.
+func (cli *CLI) newClient() *ai.AIClient {
 	aiClient := ai.NewClient(cli.OllamaURL, cli.Model)
+	aiClient.PromptTemplate = cli.prompt
+	aiClient.Instruction = cli.instruction
+	aiClient.HTTPClient = cli.httpClient
+	aiClient.Annotation = cli.Annotate
+	aiClient.Backup = cli.backup
+	return aiClient
+}
+
+func (cli *CLI) fixFile(ctx context.Context, path string, lintOutput string, diags []types.Diagnostic, updates chan<- types.FileUpdate) (ai.Edit, error) {
+	aiClient := cli.newClient()
+	if entries := cli.knowledge.Match(diags); len(entries) > 0 {
+		aiClient.Guidelines = knowledge.Format(entries)
+	}
+	if cli.Verify {
+		aiClient.WriteLock = cli.gate(filepath.Dir(path)).RLocker()
+	}
 
-	err := aiClient.FixFile(ctx, path, lintOutput, updates)
-	return err
+	edit, usage, err := aiClient.FixFile(ctx, path, lintOutput, updates)
+	cli.usage.Add(path, usage)
+	return edit, err
 }
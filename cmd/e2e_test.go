@@ -0,0 +1,565 @@
+package cmd
+
+import (
+	"bytes"
+	"deeprefactor/internal/ai/fake"
+	"deeprefactor/internal/api"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kong"
+)
+
+const fixedMistakes = `package main
+
+import (
+	"fmt"
+)
+
+func mistakes() {
+	var x int
+	fmt.Println(x)
+
+	const _ = 1_000_000
+
+	getGreeting()
+}
+
+func getGreeting() string {
+	return "Hello, World!"
+}`
+
+const fixedMistakes2 = `package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+func mistakes2() {
+	y := "Hello, World!"
+	fmt.Println(y)
+
+	fmt.Println(sum(5, 10))
+	fmt.Println(readFile("nonexistent.txt"))
+}
+
+func sum(a int, b int) int {
+	return a + b
+}
+
+func readFile(filename string) string {
+	content, _ := ioutil.ReadFile(filename)
+	return strings.ToUpper(string(content))
+}`
+
+// corpus copies the top level of testdata into a module in a temporary
+// directory. mistakes.go and mistakes2.go fail to type-check;
+// mistakes3.go is clean.
+func corpus(t *testing.T) string {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("end-to-end test")
+	}
+	dir := t.TempDir()
+	for _, name := range []string{"mistakes.go", "mistakes2.go", "mistakes3.go"} {
+		copyFile(t, filepath.Join("..", "testdata", name), filepath.Join(dir, name))
+	}
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module e2e\n\ngo 1.22\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func copyFile(t *testing.T, src, dst string) {
+	t.Helper()
+	data, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dst, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// run parses args the way main does and runs the selected command in
+// headless mode against the fake server.
+func run(t *testing.T, server *fake.Server, dir string, args ...string) (string, error) {
+	t.Helper()
+	var cli CLI
+	var out bytes.Buffer
+	cli.stdout = &out
+	err := parse(t, &cli, server, dir, args...).Run(&cli)
+	return out.String(), err
+}
+
+// parse parses args into cli the way main does, in headless mode against
+// the fake server.
+func parse(t *testing.T, cli *CLI, server *fake.Server, dir string, args ...string) *kong.Context {
+	t.Helper()
+	parser, err := kong.New(cli, kong.Name("deeprefactor"), kong.Exit(func(int) { t.Fatal("kong exited") }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := []string{"--headless", "--dir", dir, "--ollama-url", server.URL, "--checker", "analysis", "--autofix", "none"}
+	ctx, err := parser.Parse(append(base, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ctx
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// lf trims s and converts CRLF line endings, which the testdata files use
+// and fixes keep, to LF.
+func lf(s string) string {
+	return strings.TrimSpace(strings.ReplaceAll(s, "\r\n", "\n"))
+}
+
+func assertContains(t *testing.T, output string, wants ...string) {
+	t.Helper()
+	for _, want := range wants {
+		if !strings.Contains(output, want) {
+			t.Errorf("output does not contain %q:\n%s", want, output)
+		}
+	}
+}
+
+func TestFixAllFiles(t *testing.T) {
+	dir := corpus(t)
+	server := fake.New(
+		fake.Rule{Match: "mistakes.go:", Responses: []fake.Response{fake.Code(fixedMistakes)}},
+		fake.Rule{Match: "mistakes2.go:", Responses: []fake.Response{fake.Code(fixedMistakes2)}},
+	)
+	defer server.Close()
+
+	out, err := run(t, server, dir)
+	if err != nil {
+		t.Fatalf("fix failed: %v\n%s", err, out)
+	}
+	got := readFile(t, filepath.Join(dir, "mistakes.go"))
+	if lf(got) != fixedMistakes {
+		t.Errorf("mistakes.go =\n%s", got)
+	}
+	if !strings.Contains(got, "\r\n") {
+		t.Error("mistakes.go lost its CRLF line endings")
+	}
+	if got := lf(readFile(t, filepath.Join(dir, "mistakes2.go"))); got != fixedMistakes2 {
+		t.Errorf("mistakes2.go =\n%s", got)
+	}
+	if got, want := readFile(t, filepath.Join(dir, "mistakes3.go")), readFile(t, "../testdata/mistakes3.go"); got != want {
+		t.Error("mistakes3.go was clean but changed")
+	}
+	assertContains(t, out, "Fixed: 3", "declared and not used: v", "Total")
+	if n := len(server.Requests()); n != 2 {
+		t.Errorf("sent %d requests, want 2", n)
+	}
+}
+
+func TestFixRetriesBadFix(t *testing.T) {
+	dir := corpus(t)
+	stillBroken := strings.Replace(fixedMistakes, "getGreeting()\n}", "var unused int\n\tgetGreeting()\n}", 1)
+	server := fake.New(
+		fake.Rule{Match: "mistakes.go:", Responses: []fake.Response{fake.Code(stillBroken), fake.Code(fixedMistakes)}},
+		fake.Rule{Match: "mistakes2.go:", Responses: []fake.Response{fake.Code(fixedMistakes2)}},
+	)
+	defer server.Close()
+
+	out, err := run(t, server, dir)
+	if err != nil {
+		t.Fatalf("fix failed: %v\n%s", err, out)
+	}
+	assertContains(t, out, "declared and not used: unused", "Fixed: 3")
+	var retries int
+	for _, r := range server.Requests() {
+		if strings.Contains(r.Prompt, "mistakes.go:") {
+			retries++
+		}
+	}
+	if retries != 2 {
+		t.Errorf("sent %d requests for mistakes.go, want 2", retries)
+	}
+}
+
+func TestVerifyIgnoresBaselineFailures(t *testing.T) {
+	dir := corpus(t)
+	broken := "package main\n\nimport \"testing\"\n\nfunc TestAlreadyBroken(t *testing.T) {\n\tt.Fatal(\"broken before the fix\")\n}\n"
+	if err := os.WriteFile(filepath.Join(dir, "broken_test.go"), []byte(broken), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n\nfunc main() {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	server := fake.New(
+		fake.Rule{Match: "mistakes.go:", Responses: []fake.Response{fake.Code(fixedMistakes)}},
+		fake.Rule{Match: "mistakes2.go:", Responses: []fake.Response{fake.Code(fixedMistakes2)}},
+	)
+	defer server.Close()
+
+	out, err := run(t, server, dir, "--verify")
+	if err != nil {
+		t.Fatalf("fix failed: %v\n%s", err, out)
+	}
+	assertContains(t, out, "already fails to build", "Fixed: 5")
+	if got := lf(readFile(t, filepath.Join(dir, "mistakes.go"))); got != fixedMistakes {
+		t.Errorf("mistakes.go was rolled back:\n%s", got)
+	}
+}
+
+func TestBatchVerifyRevertsBreakingFix(t *testing.T) {
+	if testing.Short() {
+		t.Skip("end-to-end test")
+	}
+	dir := t.TempDir()
+	sources := map[string]string{
+		"go.mod":    "module e2e\n\ngo 1.22\n",
+		"a.go":      "package a\n\nimport \"fmt\"\n\nfunc Greeting() string {\n\tfmt.Printf(\"%d\\n\", \"x\")\n\treturn \"hi\"\n}\n",
+		"a_test.go": "package a\n\nimport \"testing\"\n\nfunc TestGreeting(t *testing.T) {\n\tif Greeting() != \"hi\" {\n\t\tt.Fatal(Greeting())\n\t}\n}\n",
+	}
+	for name, src := range sources {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	good := "package a\n\nfunc Greeting() string {\n\treturn \"hi\"\n}"
+	server := fake.New(fake.Rule{Match: "a.go:", Responses: []fake.Response{
+		fake.Code(strings.Replace(good, "hi", "bye", 1)),
+		fake.Code(good),
+	}})
+	defer server.Close()
+
+	out, err := run(t, server, dir, "--batch", "--verify")
+	if err != nil {
+		t.Fatalf("fix failed: %v\n%s", err, out)
+	}
+	assertContains(t, out, "rolled back the fixes", "--- FAIL: TestGreeting", "Fixed: 2")
+	if strings.Index(out, "a.go: Fixed") < strings.Index(out, "rolled back") {
+		t.Errorf("a.go was marked fixed before it was verified:\n%s", out)
+	}
+	if got := readFile(t, filepath.Join(dir, "a.go")); got != good+"\n" {
+		t.Errorf("a.go =\n%s", got)
+	}
+}
+
+func TestBench(t *testing.T) {
+	dir := corpus(t)
+	// A file for another platform redeclares sum, which must not count as
+	// a compile error.
+	other := "//go:build never\n\npackage main\n\nfunc sum(a, b int) int { return a - b }\n"
+	if err := os.WriteFile(filepath.Join(dir, "other.go"), []byte(other), 0644); err != nil {
+		t.Fatal(err)
+	}
+	server := fake.New(
+		fake.Rule{Match: "mistakes.go:", Responses: []fake.Response{fake.Code(fixedMistakes)}},
+		fake.Rule{Match: "mistakes2.go:", Responses: []fake.Response{fake.Code(fixedMistakes2)}},
+	)
+	defer server.Close()
+
+	out, err := run(t, server, dir, "bench", "--format", "csv", dir)
+	if err != nil {
+		t.Fatalf("bench failed: %v\n%s", err, out)
+	}
+	assertContains(t, out, "Running deepseek-coder-v2 with prompt default...", "model,prompt,files,passed,")
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	fields := strings.Split(lines[len(lines)-1], ",")
+	if len(fields) != 11 || fields[2] != "4" || fields[3] != "4" || fields[10] != "4" {
+		t.Errorf("result row = %q", lines[len(lines)-1])
+	}
+	if got := lf(readFile(t, filepath.Join(dir, "mistakes.go"))); got == fixedMistakes {
+		t.Error("bench changed the corpus")
+	}
+}
+
+func TestFixFailsOnServerErrors(t *testing.T) {
+	dir := corpus(t)
+	original := readFile(t, filepath.Join(dir, "mistakes.go"))
+	server := fake.New(fake.Rule{Responses: []fake.Response{fake.Error(http.StatusInternalServerError, "model crashed")}})
+	defer server.Close()
+
+	out, err := run(t, server, dir, "--max-retries", "2")
+	if err == nil || !strings.Contains(err.Error(), "2 of 3 files not fixed") {
+		t.Fatalf("err = %v, want two unfixed files\n%s", err, out)
+	}
+	assertContains(t, out, "model crashed", "Failed: 2", "Fixed: 1")
+	if got := readFile(t, filepath.Join(dir, "mistakes.go")); got != original {
+		t.Error("mistakes.go changed although every request failed")
+	}
+}
+
+func TestFixTokenBudget(t *testing.T) {
+	dir := corpus(t)
+	server := fake.New(fake.Rule{Responses: []fake.Response{{Text: "```go\npackage main\n\nfunc broken() { var unused int }\n```", PromptTokens: 500, CompletionTokens: 500}}})
+	defer server.Close()
+
+	out, err := run(t, server, dir, "--token-budget", "100", "--max-retries", "3")
+	if err == nil {
+		t.Fatalf("expected unfixed files\n%s", out)
+	}
+	assertContains(t, out, "Skipped", "Token budget of 100 exhausted")
+}
+
+func TestApplyPattern(t *testing.T) {
+	dir := corpus(t)
+	server := fake.New(fake.Rule{Match: "Rename getGreeting", Responses: []fake.Response{
+		fake.Code(strings.ReplaceAll(fixedMistakes, "getGreeting", "greeting")),
+	}})
+	defer server.Close()
+
+	out, err := run(t, server, dir, "apply", "--instruction", "Rename getGreeting to greeting", "--pattern", `getGreeting\(`, "--files", "mistakes.go")
+	if err != nil {
+		t.Fatalf("apply failed: %v\n%s", err, out)
+	}
+	if got := readFile(t, filepath.Join(dir, "mistakes.go")); strings.Contains(got, "getGreeting") {
+		t.Errorf("mistakes.go still calls getGreeting:\n%s", got)
+	}
+	assertContains(t, out, "still matches", "Fixed: 1")
+}
+
+func TestApplyCheckSendsEveryFile(t *testing.T) {
+	dir := corpus(t)
+	original := lf(readFile(t, filepath.Join(dir, "mistakes3.go")))
+	changed := strings.Replace(original, "func mistakes3() {", "// mistakes3 logs to a file.\nfunc mistakes3() {", 1)
+	server := fake.New(fake.Rule{Match: "Document mistakes3", Responses: []fake.Response{fake.Code(strings.TrimSuffix(changed, "\n"))}})
+	defer server.Close()
+
+	out, err := run(t, server, dir, "apply", "--instruction", "Document mistakes3", "--check", "true", "--files", "mistakes3.go")
+	if err != nil {
+		t.Fatalf("apply failed: %v\n%s", err, out)
+	}
+	if n := len(server.Requests()); n != 1 {
+		t.Errorf("sent %d requests, want 1", n)
+	}
+	if got := lf(readFile(t, filepath.Join(dir, "mistakes3.go"))); !strings.Contains(got, "// mistakes3 logs to a file.") {
+		t.Errorf("mistakes3.go was not changed:\n%s", got)
+	}
+	assertContains(t, out, "Fixed: 1")
+}
+
+func TestRecordReplay(t *testing.T) {
+	dir := corpus(t)
+	recording := t.TempDir()
+	server := fake.New(
+		fake.Rule{Match: "mistakes.go:", Responses: []fake.Response{fake.Code(fixedMistakes)}},
+		fake.Rule{Match: "mistakes2.go:", Responses: []fake.Response{fake.Code(fixedMistakes2)}},
+	)
+	if out, err := run(t, server, dir, "--record", recording); err != nil {
+		t.Fatalf("recorded run failed: %v\n%s", err, out)
+	}
+	server.Close()
+	if files, _ := filepath.Glob(filepath.Join(recording, "*.json")); len(files) != 2 {
+		t.Fatalf("recorded %d interactions, want 2", len(files))
+	}
+
+	for _, name := range []string{"mistakes.go", "mistakes2.go"} {
+		copyFile(t, filepath.Join("..", "testdata", name), filepath.Join(dir, name))
+	}
+	out, err := run(t, server, dir, "--replay", recording)
+	if err != nil {
+		t.Fatalf("replayed run failed: %v\n%s", err, out)
+	}
+	if got := lf(readFile(t, filepath.Join(dir, "mistakes.go"))); got != fixedMistakes {
+		t.Errorf("replayed mistakes.go =\n%s", got)
+	}
+}
+
+func TestFixRejectsResponsesWithoutCode(t *testing.T) {
+	dir := corpus(t)
+	original := readFile(t, filepath.Join(dir, "mistakes.go"))
+	server := fake.New(fake.Rule{Responses: []fake.Response{fake.Broken()}})
+	defer server.Close()
+
+	out, err := run(t, server, dir, "--max-retries", "1")
+	if err == nil {
+		t.Fatalf("expected unfixed files\n%s", out)
+	}
+	assertContains(t, out, "no usable Go code in response: the response contains no code block")
+	if got := readFile(t, filepath.Join(dir, "mistakes.go")); got != original {
+		t.Error("mistakes.go was overwritten with a response without code")
+	}
+}
+
+func TestUndo(t *testing.T) {
+	dir := corpus(t)
+	server := fake.New(
+		fake.Rule{Match: "mistakes.go:", Responses: []fake.Response{fake.Code(fixedMistakes)}},
+		fake.Rule{Match: "mistakes2.go:", Responses: []fake.Response{fake.Code(fixedMistakes2)}},
+	)
+	defer server.Close()
+
+	out, err := run(t, server, dir)
+	if err != nil {
+		t.Fatalf("fix failed: %v\n%s", err, out)
+	}
+	assertContains(t, out, "Backed up 2 files as run ")
+
+	edited := filepath.Join(dir, "mistakes2.go")
+	if err := os.WriteFile(edited, []byte(readFile(t, edited)+"// edited\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err = run(t, server, dir, "undo")
+	if err == nil {
+		t.Fatalf("undo restored a file edited after the run\n%s", out)
+	}
+	assertContains(t, out, "mistakes.go: restored", "mistakes2.go changed since the run")
+	if got, want := readFile(t, filepath.Join(dir, "mistakes.go")), readFile(t, "../testdata/mistakes.go"); got != want {
+		t.Errorf("restored mistakes.go =\n%s", got)
+	}
+	if !strings.HasSuffix(readFile(t, edited), "// edited\n") {
+		t.Error("undo overwrote the edited mistakes2.go")
+	}
+
+	if out, err := run(t, server, dir, "undo", "--force", "mistakes2.go"); err != nil {
+		t.Fatalf("forced undo failed: %v\n%s", err, out)
+	}
+	if got, want := readFile(t, edited), readFile(t, "../testdata/mistakes2.go"); got != want {
+		t.Errorf("restored mistakes2.go =\n%s", got)
+	}
+}
+
+// syncBuffer is a bytes.Buffer that can be read while a command writes.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestServe(t *testing.T) {
+	dir := corpus(t)
+	server := fake.New(
+		fake.Rule{Match: "mistakes.go:", Responses: []fake.Response{fake.Code(fixedMistakes)}},
+		fake.Rule{Match: "mistakes2.go:", Responses: []fake.Response{fake.Code(fixedMistakes2)}},
+	)
+	defer server.Close()
+	original := readFile(t, filepath.Join(dir, "mistakes.go"))
+
+	var cli CLI
+	cli.stdout = &syncBuffer{}
+	done := make(chan struct{})
+	ready := make(chan string, 1)
+	cli.Serve.done, cli.Serve.ready = done, ready
+	ctx := parse(t, &cli, server, dir, "serve", "--listen", "127.0.0.1:0")
+	errc := make(chan error, 1)
+	go func() { errc <- ctx.Run(&cli) }()
+	base := "http://" + <-ready
+
+	post := func(path, body string, v any) int {
+		t.Helper()
+		resp, err := http.Post(base+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+	var job api.Job
+	if code := post("/jobs", `{"dir": "."}`, &job); code != http.StatusCreated {
+		t.Fatalf("POST /jobs = %d %+v", code, job)
+	}
+	resp, err := http.Get(base + "/jobs/" + job.ID + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assertContains(t, string(stream), "event: update", `"status":"Fixed"`, "event: done")
+
+	if got := lf(readFile(t, filepath.Join(dir, "mistakes2.go"))); got != fixedMistakes2 {
+		t.Errorf("mistakes2.go =\n%s", got)
+	}
+	var decisions []api.Decision
+	body := `{"paths": [` + jsonString(filepath.Join(dir, "mistakes.go")) + `]}`
+	if code := post("/jobs/"+job.ID+"/reject", body, &decisions); code != http.StatusOK {
+		t.Fatalf("reject = %d %+v", code, decisions)
+	}
+	if got := readFile(t, filepath.Join(dir, "mistakes.go")); got != original {
+		t.Errorf("mistakes.go was not restored:\n%s", got)
+	}
+
+	close(done)
+	if err := <-errc; err != nil {
+		t.Errorf("serve failed: %v", err)
+	}
+}
+
+func jsonString(s string) string {
+	data, _ := json.Marshal(s)
+	return string(data)
+}
+
+func TestWatch(t *testing.T) {
+	dir := corpus(t)
+	server := fake.New(fake.Rule{Match: "mistakes.go:", Responses: []fake.Response{fake.Code(fixedMistakes)}})
+	defer server.Close()
+	// A Vim swap file marks mistakes2.go as open in an editor.
+	if err := os.WriteFile(filepath.Join(dir, ".mistakes2.go.swp"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	original2 := readFile(t, filepath.Join(dir, "mistakes2.go"))
+
+	var cli CLI
+	out := &syncBuffer{}
+	cli.stdout = out
+	done := make(chan struct{})
+	cli.Watch.done = done
+	ctx := parse(t, &cli, server, dir, "watch", "--debounce", "50ms", "--auto-fix")
+	errc := make(chan error, 1)
+	go func() { errc <- ctx.Run(&cli) }()
+
+	// Save the files until the watcher is up and sees them.
+	deadline := time.Now().Add(time.Minute)
+	for !strings.Contains(out.String(), "mistakes.go: Fixed") || !strings.Contains(out.String(), "mistakes2.go: Needs confirmation") {
+		if time.Now().After(deadline) {
+			t.Fatalf("files not handled:\n%s", out.String())
+		}
+		if !strings.Contains(out.String(), "Saved, checking") {
+			for _, name := range []string{"mistakes.go", "mistakes2.go"} {
+				copyFile(t, filepath.Join("..", "testdata", name), filepath.Join(dir, name))
+			}
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	close(done)
+	if err := <-errc; err == nil {
+		t.Errorf("watch reported success with a file awaiting confirmation\n%s", out.String())
+	}
+
+	if got := lf(readFile(t, filepath.Join(dir, "mistakes.go"))); got != fixedMistakes {
+		t.Errorf("mistakes.go =\n%s", got)
+	}
+	if got := readFile(t, filepath.Join(dir, "mistakes2.go")); got != original2 {
+		t.Error("mistakes2.go was changed while open in an editor")
+	}
+	if n := len(server.Requests()); n != 1 {
+		t.Errorf("model got %d requests, want 1", n)
+	}
+}
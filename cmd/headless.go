@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"deeprefactor/internal/types"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// runHeadless runs process without the interactive UI, printing each status
+// change and log line as it arrives and a summary at the end. It fails when
+// any file ends up other than Fixed, so it can gate CI jobs.
+func (cli *CLI) runHeadless(files []*types.FileProcess, process func(chan<- types.FileUpdate, []types.TableItem)) error {
+	out := cli.output()
+	byPath := make(map[string]*types.FileProcess)
+	items := make([]types.TableItem, 0, len(files))
+	for _, f := range files {
+		byPath[f.Path] = f
+		items = append(items, types.TableItem{Type: "file", Path: f.Path, File: f})
+	}
+
+	updates := make(chan types.FileUpdate, 100)
+	go process(updates, items)
+
+	for u := range updates {
+		f, ok := byPath[u.Path]
+		if !ok {
+			if u.File == nil {
+				continue
+			}
+			f = u.File
+			byPath[f.Path] = f
+			files = append(files, f)
+		}
+		f.Mutex.Lock()
+		changed := u.Status != "" && u.Status != f.Status
+		f.Apply(u)
+		f.Mutex.Unlock()
+
+		if changed {
+			fmt.Fprintf(out, "%s: %s\n", u.Path, u.Status)
+		}
+		if u.Log != "" {
+			fmt.Fprintf(out, "    %s\n", strings.ReplaceAll(u.Log, "\n", "\n    "))
+		}
+	}
+
+	counts := make(map[string]int)
+	var notFixed []string
+	for _, f := range files {
+		counts[f.Status]++
+		if f.Status != "Fixed" {
+			notFixed = append(notFixed, f.Path)
+		}
+	}
+	var parts []string
+	for status, n := range counts {
+		parts = append(parts, fmt.Sprintf("%s: %d", status, n))
+	}
+	sort.Strings(parts)
+	fmt.Fprintf(out, "\n%s\n\n", strings.Join(parts, ", "))
+	cli.usage.WriteSummary(out)
+
+	if len(notFixed) > 0 {
+		return fmt.Errorf("%d of %d files not fixed: %s", len(notFixed), len(files), strings.Join(notFixed, ", "))
+	}
+	return nil
+}
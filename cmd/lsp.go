@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"context"
+	"deeprefactor/internal/checker"
+	"deeprefactor/internal/knowledge"
+	"deeprefactor/internal/lsp"
+	"deeprefactor/internal/processor"
+	"deeprefactor/internal/types"
+	"io"
+	"os"
+)
+
+type LspCmd struct {
+	// in and out replace stdin and stdout in tests.
+	in  io.Reader
+	out io.Writer
+}
+
+// Run serves the Language Server Protocol on stdin and stdout. Fixes are
+// returned to the editor as edits instead of being written, so the editor's
+// undo replaces the backup.
+func (l *LspCmd) Run(cli *CLI) error {
+	cli.Backup = false
+	if err := cli.prepare(); err != nil {
+		return err
+	}
+	in, out := l.in, l.out
+	if in == nil {
+		in = os.Stdin
+	}
+	if out == nil {
+		out = os.Stdout
+	}
+	return lsp.Serve(context.Background(), in, out, lspEngine{cli})
+}
+
+// lspEngine runs the configured checkers and model for the language server.
+type lspEngine struct {
+	cli *CLI
+}
+
+func (e lspEngine) Check(ctx context.Context, path string) (lsp.Report, error) {
+	results := checker.RunAll(ctx, e.cli.checkList, path, e.cli.Shell)
+	report := lsp.Report{Output: checker.Format(results)}
+	for _, r := range results {
+		for _, d := range r.Diagnostics {
+			if !processor.SameFile(d.File, path) {
+				continue
+			}
+			if r.Checker.Blocking {
+				report.Errors = append(report.Errors, d)
+			} else {
+				report.Warnings = append(report.Warnings, d)
+			}
+		}
+	}
+	return report, nil
+}
+
+func (e lspEngine) Fix(ctx context.Context, path, content string, report lsp.Report, log func(string)) (string, error) {
+	aiClient := e.cli.newClient()
+	if entries := e.cli.knowledge.Match(report.Errors); len(entries) > 0 {
+		aiClient.Guidelines = knowledge.Format(entries)
+	}
+
+	updates := make(chan types.FileUpdate)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for u := range updates {
+			if u.Log != "" {
+				log(u.Log)
+			}
+		}
+	}()
+	fixed, _, err := aiClient.GetFixedCode(ctx, path, content, report.Output, updates)
+	close(updates)
+	<-done
+	return fixed, err
+}
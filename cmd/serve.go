@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"context"
+	"deeprefactor/internal/api"
+	"deeprefactor/internal/backup"
+	"deeprefactor/internal/knowledge"
+	"deeprefactor/internal/processor"
+	"deeprefactor/internal/types"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+)
+
+type ServeCmd struct {
+	Listen string `flag:"" default:"127.0.0.1:8484" help:"Address to listen on"`
+	Token  string `flag:"" env:"DEEPREFACTOR_TOKEN" help:"Require this bearer token on every request"`
+
+	// done stops the server in tests, and ready receives the address it
+	// listens on.
+	done  <-chan struct{}
+	ready chan<- string
+}
+
+// Run serves the HTTP/JSON API for fix jobs until interrupted. Every job
+// runs the fix loop with the configuration of the command line and gets
+// its own backup and token budget.
+func (s *ServeCmd) Run(cli *CLI) error {
+	// Each job makes its own backup run.
+	backups := cli.Backup
+	cli.Backup = false
+	if err := cli.prepare(); err != nil {
+		return err
+	}
+	cli.Backup = backups
+
+	ln, err := net.Listen("tcp", s.Listen)
+	if err != nil {
+		return err
+	}
+	host, _, err := net.SplitHostPort(s.Listen)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Handler:           api.NewServer(cli.Dir, serveRunner{cli}, s.Token, host).Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	fmt.Fprintf(cli.output(), "Serving the DeepRefactor API for %s on http://%s\n", cli.Dir, ln.Addr())
+	if s.ready != nil {
+		s.ready <- ln.Addr().String()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-s.done:
+		}
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdown)
+	}()
+
+	if err := server.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// serveRunner runs the jobs of the API server.
+type serveRunner struct {
+	cli *CLI
+}
+
+func (r serveRunner) Files(dir string) ([]*types.FileProcess, error) {
+	return processor.FindGoFiles(dir)
+}
+
+func (r serveRunner) FixFiles(files []*types.FileProcess, updates chan<- types.FileUpdate) {
+	job := *r.cli
+	job.usage = newUsageTracker()
+	job.gates = newPackageGates()
+	if r.cli.Backup {
+		run, err := backup.NewRun(r.cli.Dir)
+		if err != nil {
+			for _, f := range files {
+				updates <- types.FileUpdate{Path: f.Path, Status: "Failed", Log: err.Error()}
+			}
+			close(updates)
+			return
+		}
+		job.backup = run
+	}
+
+	items := make([]types.TableItem, 0, len(files))
+	for _, f := range files {
+		items = append(items, types.TableItem{Type: "file", Path: f.Path, File: f})
+	}
+	inner := make(chan types.FileUpdate, 100)
+	go job.processFiles(inner, items)
+	for u := range inner {
+		updates <- u
+	}
+
+	job.finishBackup()
+	close(updates)
+}
+
+func (r serveRunner) FixContent(ctx context.Context, path, content, lintOutput string, updates chan<- types.FileUpdate) (string, error) {
+	aiClient := r.cli.newClient()
+	if entries := r.cli.knowledge.Match(processor.ParseDiagnostics(lintOutput)); len(entries) > 0 {
+		aiClient.Guidelines = knowledge.Format(entries)
+	}
+	fixed, _, err := aiClient.GetFixedCode(ctx, path, content, lintOutput, updates)
+	return fixed, err
+}
@@ -0,0 +1,199 @@
+package cmd
+
+import (
+	"context"
+	"deeprefactor/internal/ai"
+	"deeprefactor/internal/coverage"
+	"deeprefactor/internal/processor"
+	"deeprefactor/internal/types"
+	"deeprefactor/pkg/utils"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type TestsCmd struct {
+	Files []string `flag:"" sep:"," help:"Glob patterns selecting source files, matched against the path relative to --dir or the file name (default: all)"`
+}
+
+// testTarget is a source file with uncovered functions and the test file
+// generated for it.
+type testTarget struct {
+	source string
+	funcs  []coverage.Func
+}
+
+// Run writes tests for the functions without coverage. Each source file
+// gets a new test file that is regenerated until its tests pass, and is
+// deleted if they still fail after --max-retries attempts.
+func (t *TestsCmd) Run(cli *CLI) error {
+	if cli.Batch {
+		return errors.New("--batch is not supported by tests")
+	}
+	if err := cli.prepare(); err != nil {
+		return err
+	}
+	if cli.PromptTemplate == "" {
+		cli.prompt = ai.DefaultTestTemplate
+	}
+
+	fmt.Fprintln(cli.output(), "Measuring coverage...")
+	uncovered, err := coverage.Uncovered(context.Background(), cli.Dir)
+	if err != nil {
+		return err
+	}
+
+	var sources []*types.FileProcess
+	for path := range uncovered {
+		sources = append(sources, &types.FileProcess{Path: path})
+	}
+	if sources, err = selectFiles(cli.Dir, t.Files, sources); err != nil {
+		return err
+	}
+
+	targets := make(map[string]testTarget)
+	var files []*types.FileProcess
+	for _, src := range sources {
+		testPath := testFileFor(src.Path)
+		if testPath == "" {
+			fmt.Fprintf(cli.output(), "Skipping %s: no free test file name\n", src.Path)
+			continue
+		}
+		targets[testPath] = testTarget{source: src.Path, funcs: uncovered[src.Path]}
+		files = append(files, &types.FileProcess{Path: testPath, Status: "Pending"})
+	}
+	if len(files) == 0 {
+		fmt.Fprintln(cli.output(), "Every function is covered by a test")
+		return nil
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+
+	// The test files of a package are generated one after another, since a
+	// broken one would fail the test runs of the others.
+	return cli.runTUI(files, func(path string) string { return "go test " + path }, func(updates chan<- types.FileUpdate, items []types.TableItem) {
+		var wg sync.WaitGroup
+		for _, files := range groupByPackage(items) {
+			wg.Add(1)
+			go func(files []*types.FileProcess) {
+				defer wg.Done()
+				for _, file := range files {
+					cli.generateTests(file, targets[file.Path], updates)
+				}
+			}(files)
+		}
+		wg.Wait()
+		close(updates)
+	})
+}
+
+// testFileFor picks a test file name next to source that does not exist
+// yet, or returns "" if both candidates are taken.
+func testFileFor(source string) string {
+	base := strings.TrimSuffix(source, ".go")
+	for _, name := range []string{base + "_test.go", base + "_gen_test.go"} {
+		if _, err := os.Stat(name); errors.Is(err, os.ErrNotExist) {
+			return name
+		}
+	}
+	return ""
+}
+
+// generateTests asks the model for tests of target in file.Path and runs
+// them after each attempt, feeding failures back to the model.
+func (cli *CLI) generateTests(file *types.FileProcess, target testTarget, updates chan<- types.FileUpdate) {
+	ctx := context.Background()
+	source, err := os.ReadFile(target.source)
+	if err != nil {
+		updates <- types.FileUpdate{Path: file.Path, Status: "Failed", Log: err.Error()}
+		return
+	}
+	pkg, err := parser.ParseFile(token.NewFileSet(), target.source, source, parser.PackageClauseOnly)
+	if err != nil {
+		updates <- types.FileUpdate{Path: file.Path, Status: "Failed", Log: err.Error()}
+		return
+	}
+
+	stub := fmt.Sprintf("package %s\n", pkg.Name.Name)
+	if err := cli.backup.Save(file.Path); err != nil {
+		updates <- types.FileUpdate{Path: file.Path, Status: "Failed", Log: err.Error()}
+		return
+	}
+	if err := utils.SafeWriteFile(file.Path, stub); err != nil {
+		updates <- types.FileUpdate{Path: file.Path, Status: "Failed", Log: err.Error()}
+		return
+	}
+	file.Mutex.Lock()
+	file.Original = stub
+	file.Mutex.Unlock()
+
+	var names []string
+	for _, fn := range target.funcs {
+		names = append(names, fmt.Sprintf("- %s (line %d)", fn.Name, fn.Line))
+	}
+	aiClient := cli.newClient()
+	aiClient.Instruction = strings.Join(names, "\n")
+	aiClient.Source = string(source)
+	updates <- types.FileUpdate{Path: file.Path, Log: fmt.Sprintf("Uncovered functions in %s:\n%s", target.source, aiClient.Instruction)}
+
+	testOutput := ""
+	for attempt := 1; attempt <= cli.MaxRetries; attempt++ {
+		updates <- types.FileUpdate{
+			Path:   file.Path,
+			Status: fmt.Sprintf("Attempt %d/%d", attempt, cli.MaxRetries),
+		}
+		if cli.usage.Exhausted(cli.TokenBudget) {
+			os.Remove(file.Path)
+			updates <- types.FileUpdate{Path: file.Path, Status: "Skipped", Log: fmt.Sprintf("Token budget of %d exhausted, removed the test file", cli.TokenBudget)}
+			return
+		}
+
+		_, usage, err := aiClient.FixFile(ctx, file.Path, testOutput, updates)
+		cli.usage.Add(file.Path, usage)
+		if err != nil {
+			updates <- types.FileUpdate{Path: file.Path, Log: fmt.Sprintf("Fix error: %v", err)}
+			continue
+		}
+
+		updates <- types.FileUpdate{Path: file.Path, Status: "Verifying"}
+		if testOutput, err = cli.runGeneratedTests(ctx, file.Path); err == nil {
+			updates <- types.FileUpdate{Path: file.Path, Status: "Fixed", Log: "Generated tests pass"}
+			return
+		}
+		updates <- types.FileUpdate{
+			Path:   file.Path,
+			Status: "Failing: go test",
+			Log:    fmt.Sprintf("Tests failed:\n%s", testOutput),
+		}
+	}
+
+	os.Remove(file.Path)
+	updates <- types.FileUpdate{Path: file.Path, Status: "Failed", Log: "Removed the test file"}
+}
+
+// runGeneratedTests builds the package of path and runs only the tests
+// declared in path. The output is returned on failure.
+func (cli *CLI) runGeneratedTests(ctx context.Context, path string) (string, error) {
+	file, err := parser.ParseFile(token.NewFileSet(), path, nil, parser.SkipObjectResolution)
+	if err != nil {
+		return err.Error(), err
+	}
+	var tests []string
+	for _, decl := range file.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok && fn.Recv == nil && strings.HasPrefix(fn.Name.Name, "Test") {
+			tests = append(tests, regexp.QuoteMeta(fn.Name.Name))
+		}
+	}
+	if len(tests) == 0 {
+		err := errors.New("the test file declares no Test functions")
+		return err.Error(), err
+	}
+	return processor.VerifyPackage(ctx, filepath.Dir(path), "^("+strings.Join(tests, "|")+")$", cli.VerifyTimeout)
+}
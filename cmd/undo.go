@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"deeprefactor/internal/backup"
+	"deeprefactor/internal/processor"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+type UndoCmd struct {
+	Args  []string `arg:"" optional:"" name:"run-id|files" help:"Run to undo (default: the latest), then the files to restore (default: all)"`
+	Force bool     `flag:"" help:"Restore files even if they changed after the run"`
+	List  bool     `flag:"" help:"List the runs with backups and exit"`
+}
+
+// Run restores the originals saved by a run in --dir. Files that changed
+// after the run are skipped with a warning unless --force is given, so
+// later edits are not lost by accident.
+func (u *UndoCmd) Run(cli *CLI) error {
+	out := cli.output()
+	if u.List {
+		runs, err := backup.List(cli.Dir)
+		if err != nil {
+			return err
+		}
+		for _, m := range runs {
+			state := ""
+			if !m.Finished {
+				state = " (interrupted)"
+			}
+			fmt.Fprintf(out, "%s  %s  %d files%s\n", m.ID, m.Started.Format("2006-01-02 15:04:05"), len(m.Files), state)
+		}
+		return nil
+	}
+
+	id, files := "", u.Args
+	if len(files) > 0 {
+		if _, err := os.Stat(filepath.Join(backup.Dir(cli.Dir), files[0], "manifest.json")); err == nil {
+			id, files = files[0], files[1:]
+		}
+	}
+	run, err := backup.Load(cli.Dir, id)
+	if err != nil {
+		return err
+	}
+
+	restored, skipped := 0, 0
+	matched := make([]bool, len(files))
+	for _, e := range run.Manifest().Files {
+		if len(files) > 0 && !selected(run.Abs(e), e.Path, files, matched) {
+			continue
+		}
+		removed, err := run.Restore(e, u.Force)
+		switch {
+		case errors.Is(err, backup.ErrChanged):
+			fmt.Fprintf(out, "warning: %v; use --force to restore it anyway\n", err)
+			skipped++
+		case err != nil:
+			return err
+		case removed:
+			fmt.Fprintf(out, "%s: removed, the run created it\n", e.Path)
+			restored++
+		default:
+			fmt.Fprintf(out, "%s: restored\n", e.Path)
+			restored++
+		}
+	}
+	for i, f := range files {
+		if !matched[i] {
+			fmt.Fprintf(out, "warning: %s is not in run %s\n", f, run.ID())
+		}
+	}
+
+	fmt.Fprintf(out, "Restored %d files from run %s\n", restored, run.ID())
+	if skipped > 0 {
+		return fmt.Errorf("%d files changed since run %s were not restored", skipped, run.ID())
+	}
+	return nil
+}
+
+// selected reports whether the file at abs, recorded as rel, is one of
+// files and marks the ones that match.
+func selected(abs, rel string, files []string, matched []bool) bool {
+	found := false
+	for i, f := range files {
+		if f == rel || processor.SameFile(f, abs) {
+			matched[i] = true
+			found = true
+		}
+	}
+	return found
+}
@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"deeprefactor/internal/types"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"text/tabwriter"
+)
+
+type usageTracker struct {
+	mu      sync.Mutex
+	perFile map[string]types.Usage
+	total   types.Usage
+}
+
+func newUsageTracker() *usageTracker {
+	return &usageTracker{perFile: make(map[string]types.Usage)}
+}
+
+func (t *usageTracker) Add(path string, u types.Usage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fu := t.perFile[path]
+	fu.Add(u)
+	t.perFile[path] = fu
+	t.total.Add(u)
+}
+
+func (t *usageTracker) Total() types.Usage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.total
+}
+
+// Exhausted reports whether the run has used up its token budget. A budget
+// of zero means unlimited.
+func (t *usageTracker) Exhausted(budget int) bool {
+	return budget > 0 && t.Total().Tokens() >= budget
+}
+
+func (t *usageTracker) WriteSummary(w io.Writer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var paths []string
+	for path := range t.perFile {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "File\tRequests\tPrompt\tCompletion\tTokens\tSeconds\t")
+	row := func(name string, u types.Usage) {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%.1f\t\n",
+			name, u.Requests, u.PromptTokens, u.CompletionTokens, u.Tokens(), u.Duration.Seconds())
+	}
+	for _, path := range paths {
+		row(path, t.perFile[path])
+	}
+	row("Total", t.total)
+	tw.Flush()
+}
@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"context"
+	"deeprefactor/internal/ai"
+	"deeprefactor/internal/processor"
+	"deeprefactor/internal/types"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// packageGates holds the verification state of every package a run fixes.
+type packageGates struct {
+	mu    sync.Mutex
+	gates map[string]*packageGate
+}
+
+// packageGate orders the writes to the files of a package around its
+// verification: fixes are written under the read lock and the package is
+// built and tested under the write lock, so that no fix lands while a run
+// is being judged.
+type packageGate struct {
+	sync.RWMutex
+	once     sync.Once
+	baseline failureSet
+}
+
+// failureSet is the outcome of a verification run.
+type failureSet struct {
+	failures []string
+	// tested is false when the build failed, so the tests did not run.
+	tested bool
+}
+
+// runVerification builds and tests the package in dir and returns the
+// failures along with the output and error of processor.VerifyPackage.
+func (cli *CLI) runVerification(ctx context.Context, dir string) (failureSet, string, error) {
+	output, err := processor.VerifyPackage(ctx, dir, cli.VerifyRun, cli.VerifyTimeout)
+	var se *processor.StepError
+	tested := !errors.As(err, &se) || se.Step != "build"
+	return failureSet{failures: processor.Failures(output, err), tested: tested}, output, err
+}
+
+// added returns the failures of s that base does not have. Test failures
+// only count when base got as far as running the tests.
+func (s failureSet) added(base failureSet) []string {
+	known := make(map[string]bool)
+	for _, f := range base.failures {
+		known[f] = true
+	}
+	var added []string
+	for _, f := range s.failures {
+		if !known[f] && (base.tested || !strings.HasPrefix(f, "test: ")) {
+			added = append(added, f)
+		}
+	}
+	return added
+}
+
+func newPackageGates() *packageGates {
+	return &packageGates{gates: make(map[string]*packageGate)}
+}
+
+// gate returns the gate of the package in dir.
+func (cli *CLI) gate(dir string) *packageGate {
+	cli.gates.mu.Lock()
+	defer cli.gates.mu.Unlock()
+	g, ok := cli.gates.gates[dir]
+	if !ok {
+		g = &packageGate{}
+		cli.gates.gates[dir] = g
+	}
+	return g
+}
+
+// takeBaseline builds and tests the package of path once per run, before
+// the first fix to it, so that verification only blames fixes for failures
+// the package did not have already. Every file must call it before it is
+// first written.
+func (cli *CLI) takeBaseline(ctx context.Context, path string, updates chan<- types.FileUpdate) {
+	g := cli.gate(filepath.Dir(path))
+	g.once.Do(func() {
+		g.baseline, _, _ = cli.runVerification(ctx, filepath.Dir(path))
+		if len(g.baseline.failures) > 0 {
+			updates <- types.FileUpdate{Path: path, Log: fmt.Sprintf("The package already fails to build or test; verification ignores these failures:\n%s", strings.Join(g.baseline.failures, "\n"))}
+		}
+	})
+}
+
+// verify builds and tests the package of the fixed file and compares the
+// failures with its baseline. New failures are checked again without the
+// fix, so that a fix to another file that is still waiting for its own
+// verification is not blamed on this one. If this fix is to blame it is
+// reverted, keeping edits made to the file since, and an error describing
+// the failure is returned. It wraps ai.ErrConflict when the fix cannot be
+// reverted without losing such edits.
+func (cli *CLI) verify(ctx context.Context, fix ai.Edit, updates chan<- types.FileUpdate) error {
+	updates <- types.FileUpdate{Path: fix.Path, Status: "Verifying"}
+	dir := filepath.Dir(fix.Path)
+	g := cli.gate(dir)
+	g.Lock()
+	defer g.Unlock()
+
+	with, output, err := cli.runVerification(ctx, dir)
+	added := with.added(g.baseline)
+	if len(added) == 0 {
+		updates <- types.FileUpdate{Path: fix.Path, Log: "Build and tests passed"}
+		return nil
+	}
+	merged, werr := fix.Revert(cli.backup)
+	if werr != nil {
+		return fmt.Errorf("verification failed (%v) and rollback failed: %w", err, werr)
+	}
+	if merged {
+		updates <- types.FileUpdate{Path: fix.Path, Log: "The file changed after the fix, kept those changes while rolling it back"}
+	}
+	without, _, _ := cli.runVerification(ctx, dir)
+	if len(failureSet{failures: added, tested: true}.added(without)) > 0 {
+		return fmt.Errorf("verification failed, rolled back the fix: %v\n%s", err, output)
+	}
+	if merged, werr = fix.Write(cli.backup); werr != nil {
+		return fmt.Errorf("reapply the fix after verification: %w", werr)
+	}
+	if merged {
+		updates <- types.FileUpdate{Path: fix.Path, Log: "The file changed during verification, merged the edits with the fix"}
+	}
+	updates <- types.FileUpdate{Path: fix.Path, Log: fmt.Sprintf("The package fails without this fix too, kept it:\n%s", strings.Join(added, "\n"))}
+	return nil
+}
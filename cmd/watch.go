@@ -0,0 +1,278 @@
+package cmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"deeprefactor/internal/checker"
+	"deeprefactor/internal/types"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+type WatchCmd struct {
+	Debounce time.Duration `flag:"" default:"500ms" help:"Wait this long after the last change to a file before checking it"`
+	AutoFix  bool          `flag:"" name:"auto-fix" help:"Fix failing files without asking, except files open in an editor that leaves a swap or lock file"`
+
+	// done ends the watch in tests; without it the watch runs until
+	// interrupted.
+	done <-chan struct{}
+}
+
+// Run watches --dir and checks each Go file a moment after it is saved,
+// fixing it with the usual loop if the checks fail. Fixes wait for the user
+// to press y unless --auto-fix is set; files that an editor holds open
+// always wait, since many editors leave no trace of that.
+func (w *WatchCmd) Run(cli *CLI) error {
+	if cli.Batch {
+		return errors.New("--batch is not supported by watch")
+	}
+	if err := cli.prepare(); err != nil {
+		return err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("start watching: %w", err)
+	}
+	defer watcher.Close()
+	if err := watchTree(watcher, cli.Dir); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if w.done != nil {
+		go func() {
+			select {
+			case <-w.done:
+				stop()
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	s := &watchSession{
+		cli:       cli,
+		cmd:       w,
+		ctx:       ctx,
+		watcher:   watcher,
+		due:       make(chan string),
+		confirmed: make(chan string, 16),
+		finished:  make(chan workerResult),
+		files:     make(map[string]*types.FileProcess),
+		seen:      make(map[string][sha256.Size]byte),
+		busy:      make(map[string]bool),
+		again:     make(map[string]bool),
+		waiting:   make(map[string]bool),
+	}
+	cli.confirm = func(path string) {
+		select {
+		case s.confirmed <- path:
+		default:
+		}
+	}
+	return cli.runTUI(nil, cli.lintTitle, s.run)
+}
+
+// watchSession is the state of a running watch. Only the run loop touches
+// the maps.
+type watchSession struct {
+	cli     *CLI
+	cmd     *WatchCmd
+	ctx     context.Context
+	watcher *fsnotify.Watcher
+
+	due       chan string
+	confirmed chan string
+	finished  chan workerResult
+	workers   sync.WaitGroup
+
+	files map[string]*types.FileProcess
+	// seen holds the content each file had when last checked or fixed, so
+	// that our own writes and saves without changes are ignored.
+	seen    map[string][sha256.Size]byte
+	busy    map[string]bool
+	again   map[string]bool
+	waiting map[string]bool
+}
+
+func (s *watchSession) run(updates chan<- types.FileUpdate, _ []types.TableItem) {
+	timers := make(map[string]*time.Timer)
+	defer close(updates)
+	defer s.workers.Wait()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			for _, t := range timers {
+				t.Stop()
+			}
+			return
+
+		case event, ok := <-s.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					watchTree(s.watcher, event.Name)
+					continue
+				}
+			}
+			if !strings.HasSuffix(event.Name, ".go") || !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) {
+				continue
+			}
+			path := event.Name
+			if t, ok := timers[path]; ok {
+				t.Reset(s.cmd.Debounce)
+				continue
+			}
+			timers[path] = time.AfterFunc(s.cmd.Debounce, func() {
+				select {
+				case s.due <- path:
+				case <-s.ctx.Done():
+				}
+			})
+
+		case <-s.watcher.Errors:
+			// Lost events only delay checks until the next save.
+
+		case path := <-s.due:
+			delete(timers, path)
+			s.check(path, false, updates)
+
+		case path := <-s.confirmed:
+			if s.waiting[path] {
+				delete(s.waiting, path)
+				delete(s.seen, path)
+				s.check(path, true, updates)
+			}
+
+		case r := <-s.finished:
+			delete(s.busy, r.path)
+			s.seen[r.path] = r.sum
+			if r.waiting {
+				s.waiting[r.path] = true
+			}
+			if s.again[r.path] {
+				delete(s.again, r.path)
+				s.check(r.path, false, updates)
+			}
+		}
+	}
+}
+
+// check starts a worker for path unless its content is unchanged since the
+// last check. A path that is busy is checked again when its worker ends.
+func (s *watchSession) check(path string, confirmed bool, updates chan<- types.FileUpdate) {
+	if s.busy[path] {
+		s.again[path] = true
+		return
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	sum := sha256.Sum256(content)
+	if seen, ok := s.seen[path]; ok && seen == sum {
+		return
+	}
+	s.seen[path] = sum
+	delete(s.waiting, path)
+
+	file, ok := s.files[path]
+	if !ok {
+		file = &types.FileProcess{Path: path, Status: "Pending"}
+		s.files[path] = file
+	}
+	updates <- types.FileUpdate{Path: path, Status: "Pending", Log: "Saved, checking", File: file}
+
+	ask := !confirmed && (!s.cmd.AutoFix || openInEditor(path))
+	s.busy[path] = true
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		r := workerResult{path: path}
+		if ask {
+			r.waiting = s.needsFix(path, updates)
+		} else {
+			s.cli.processFile(file, updates)
+		}
+		if content, err := os.ReadFile(path); err == nil {
+			r.sum = sha256.Sum256(content)
+		}
+		select {
+		case s.finished <- r:
+		case <-s.ctx.Done():
+		}
+	}()
+}
+
+// workerResult is what a worker reports about path when it ends.
+type workerResult struct {
+	path string
+	// sum is the hash of the content the worker left.
+	sum [sha256.Size]byte
+	// waiting is set when the fix awaits confirmation.
+	waiting bool
+}
+
+// needsFix runs the checks on path and, if they fail, asks the user to
+// confirm the fix.
+func (s *watchSession) needsFix(path string, updates chan<- types.FileUpdate) bool {
+	results := checker.RunAll(s.ctx, s.cli.checkList, path, s.cli.Shell)
+	if len(checker.Blocking(results)) == 0 {
+		updates <- types.FileUpdate{Path: path, Status: "Fixed", Log: "Lint passed", Diagnostics: diagnosticsFor(path, results)}
+		return false
+	}
+	why := "--auto-fix is not set"
+	if s.cmd.AutoFix {
+		why = "the file is open in an editor"
+	}
+	updates <- types.FileUpdate{
+		Path:        path,
+		Status:      "Needs confirmation",
+		Log:         fmt.Sprintf("Lint errors:\n%s\nNot fixing because %s; press y to fix it", checker.Format(results), why),
+		Diagnostics: diagnosticsFor(path, results),
+	}
+	return true
+}
+
+// watchTree adds dir and its subdirectories to watcher, skipping hidden
+// ones such as .git and .deeprefactor.
+func watchTree(watcher *fsnotify.Watcher, dir string) error {
+	return filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+		if path != dir && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if err := watcher.Add(path); err != nil {
+			return fmt.Errorf("watch %s: %w", path, err)
+		}
+		return nil
+	})
+}
+
+// openInEditor reports whether an editor keeps a swap or lock file next to
+// path, as Vim (.name.swp) and Emacs (.#name) do. Editors such as VS Code,
+// GoLand and Helix leave no trace, which is why fixes are confirmed by
+// default.
+func openInEditor(path string) bool {
+	dir, name := filepath.Split(path)
+	for _, lock := range []string{"." + name + ".swp", "." + name + ".swo", ".#" + name, "#" + name + "#"} {
+		if _, err := os.Lstat(filepath.Join(dir, lock)); err == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -4,54 +4,175 @@ package ai
 import (
 	"bytes"
 	"context"
+	"deeprefactor/internal/annotate"
+	"deeprefactor/internal/backup"
 	"deeprefactor/internal/types"
 	"deeprefactor/pkg/utils"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
 )
 
+// DefaultPromptTemplate is the text/template used to ask the model for a
+// fix. It receives a PromptData value.
+const DefaultPromptTemplate = `Fix these Go lint errors in {{.Path}}:
+{{.Errors}}
+{{if .Guidelines}}
+How to fix these rules:
+{{.Guidelines}}
+{{end}}
+File content:
+{{.Content}}
+
+Return only the corrected Go code. {{.Annotation}} Use code blocks.`
+
+// DefaultInstructionTemplate is the prompt used by the apply command. The
+// errors list what the success checks still report.
+const DefaultInstructionTemplate = `Apply this change to {{.Path}}:
+{{.Instruction}}
+{{if .Errors}}
+The following still needs to change:
+{{.Errors}}
+{{end}}
+File content:
+{{.Content}}
+
+Return only the complete updated Go code. Keep everything unrelated to the change as it is. {{.Annotation}} Use code blocks.`
+
+// DefaultTestTemplate is the prompt used by the tests command. The
+// instruction lists the uncovered functions.
+const DefaultTestTemplate = `Write table-driven Go tests in {{.Path}} for these functions, which no test covers yet:
+{{.Instruction}}
+
+Code under test:
+{{.Source}}
+
+Current test file:
+{{.Content}}
+{{if .Errors}}
+go test reported:
+{{.Errors}}
+{{end}}
+Return only the complete test file. Use the standard testing package, name the tests TestXxx and do not change the code under test. Use code blocks.`
+
+type PromptData struct {
+	Path    string
+	Errors  string
+	Content string
+	// Guidelines holds the knowledge base entries for the rules that
+	// fired, or is empty.
+	Guidelines string
+	// Instruction is the requested change in apply mode.
+	Instruction string
+	// Source is the code under test when generating tests.
+	Source string
+	// Annotation tells the model how to mark its changes.
+	Annotation string
+}
+
 type AIClient struct {
-	OllamaURL string
-	Model     string
+	OllamaURL      string
+	Model          string
+	PromptTemplate string
+	// Guidelines is passed to the prompt template as .Guidelines.
+	Guidelines string
+	// Instruction is passed to the prompt template as .Instruction.
+	Instruction string
+	// Source is passed to the prompt template as .Source.
+	Source string
+	// HTTPClient sends the requests; nil means http.DefaultClient.
+	HTTPClient *http.Client
+	// Annotation is the annotate policy for [DeepRefactor] comments.
+	Annotation string
+	// Backup saves the original of a file before the first write to it;
+	// nil disables backups.
+	Backup *backup.Run
+	// WriteLock, if set, is held while FixFile writes the fix.
+	WriteLock sync.Locker
 }
 
 func NewClient(ollamaURL, model string) *AIClient {
 	return &AIClient{
-		OllamaURL: ollamaURL,
-		Model:     model,
+		OllamaURL:      ollamaURL,
+		Model:          model,
+		PromptTemplate: DefaultPromptTemplate,
+		Annotation:     annotate.Inline,
 	}
 }
 
-func (c *AIClient) FixFile(ctx context.Context, path string, lintOutput string, updates chan<- types.FileUpdate) error {
-	content, err := os.ReadFile(path)
+func (c *AIClient) BuildPrompt(data PromptData) (string, error) {
+	tmpl, err := template.New("prompt").Parse(c.PromptTemplate)
 	if err != nil {
-		return fmt.Errorf("read file: %w", err)
+		return "", fmt.Errorf("parse prompt template: %w", err)
+	}
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, data); err != nil {
+		return "", fmt.Errorf("execute prompt template: %w", err)
 	}
+	return sb.String(), nil
+}
+
+// ErrConflict is returned by FixFile when the file was edited while the
+// model was working and the edits overlap the fix.
+var ErrConflict = errors.New("file changed during the fix")
 
-	fixed, err := c.GetFixedCode(ctx, path, string(content), lintOutput, updates)
+// FixFile asks the model to fix path and writes the result. If the file
+// changes on disk in the meantime, the fix is merged with the new content
+// line by line, and ErrConflict is returned if they overlap. The returned
+// edit holds the fix as the model made it, so that it can be reverted.
+func (c *AIClient) FixFile(ctx context.Context, path string, lintOutput string, updates chan<- types.FileUpdate) (Edit, types.Usage, error) {
+	content, err := os.ReadFile(path)
 	if err != nil {
-		return fmt.Errorf("AI fix: %w", err)
+		return Edit{}, types.Usage{}, fmt.Errorf("read file: %w", err)
 	}
 
-	if err := utils.SafeWriteFile(path, fixed); err != nil {
-		return fmt.Errorf("write file: %w", err)
+	fixed, usage, err := c.GetFixedCode(ctx, path, string(content), lintOutput, updates)
+	if err != nil {
+		return Edit{}, usage, fmt.Errorf("AI fix: %w", err)
 	}
 
+	edit := Edit{Path: path, Before: string(content), After: fixed}
+	if c.WriteLock != nil {
+		c.WriteLock.Lock()
+	}
+	merged, err := edit.Write(c.Backup)
+	if c.WriteLock != nil {
+		c.WriteLock.Unlock()
+	}
+	if err != nil {
+		return Edit{}, usage, err
+	}
+	if merged {
+		updates <- types.FileUpdate{Path: path, Log: "File changed during the fix, merged the edits with the fix"}
+	}
 	updates <- types.FileUpdate{Path: path, Log: "Applied AI fix"}
-	return nil
+	return edit, usage, nil
 }
 
-func (c *AIClient) GetFixedCode(ctx context.Context, path, content, errors string, updates chan<- types.FileUpdate) (string, error) {
-	prompt := fmt.Sprintf(`Fix these Go lint errors in %s:
-%s
-
-File content:
-%s
-
-Return only the corrected Go code with [DeepRefactor] comments. Use code blocks.`, path, errors, content)
+func (c *AIClient) GetFixedCode(ctx context.Context, path, content, errors string, updates chan<- types.FileUpdate) (string, types.Usage, error) {
+	// Markers from earlier runs are noise to the model.
+	if stripped, _, err := annotate.Strip([]byte(content)); err == nil {
+		content = string(stripped)
+	}
+	prompt, err := c.BuildPrompt(PromptData{
+		Path:        path,
+		Errors:      errors,
+		Content:     content,
+		Guidelines:  c.Guidelines,
+		Instruction: c.Instruction,
+		Source:      c.Source,
+		Annotation:  annotate.Instruction(c.Annotation),
+	})
+	if err != nil {
+		return "", types.Usage{}, err
+	}
 
 	reqBody := struct {
 		Model  string `json:"model"`
@@ -64,42 +185,76 @@ Return only the corrected Go code with [DeepRefactor] comments. Use code blocks.
 	}
 
 	updates <- types.FileUpdate{Path: path, Log: "Sending request to ollama!"}
-	resp, err := c.SendOllamaRequest(ctx, reqBody)
+	resp, usage, err := c.SendOllamaRequest(ctx, reqBody)
 	if err != nil {
-		return "", err
+		return "", usage, err
 	}
 
-	return utils.ExtractCodeBlock(resp), nil
+	updates <- types.FileUpdate{
+		Path:  path,
+		Log:   fmt.Sprintf("Model used %d prompt + %d completion tokens in %.1fs", usage.PromptTokens, usage.CompletionTokens, usage.Duration.Seconds()),
+		Usage: usage,
+	}
+	extraction, err := utils.ExtractGoCode(resp, utils.Packages(path, content)...)
+	if err != nil {
+		return "", usage, err
+	}
+	if n := len(extraction.Candidates); n > 1 {
+		updates <- types.FileUpdate{Path: path, Log: fmt.Sprintf("Using code block %d of %d", extraction.Chosen+1, n)}
+	}
+	code, err := annotate.Apply(c.Annotation, []byte(extraction.Code))
+	if err != nil {
+		return "", usage, fmt.Errorf("apply annotation policy: %w", err)
+	}
+	return string(code), usage, nil
 }
 
-func (c *AIClient) SendOllamaRequest(ctx context.Context, reqBody interface{}) (string, error) {
+func (c *AIClient) SendOllamaRequest(ctx context.Context, reqBody interface{}) (string, types.Usage, error) {
 	body, err := json.Marshal(reqBody)
 	if err != nil {
-		return "", fmt.Errorf("marshal request failed: %w", err)
+		return "", types.Usage{}, fmt.Errorf("marshal request failed: %w", err)
 	}
 
 	req, err := http.NewRequestWithContext(ctx, "POST", c.OllamaURL+"/api/generate", bytes.NewReader(body))
 	if err != nil {
-		return "", fmt.Errorf("create request failed: %w", err)
+		return "", types.Usage{}, fmt.Errorf("create request failed: %w", err)
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	start := time.Now()
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("API request failed: %w", err)
+		return "", types.Usage{}, fmt.Errorf("API request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("API error %d: %s", resp.StatusCode, string(body))
+		return "", types.Usage{}, fmt.Errorf("API error %d: %s", resp.StatusCode, string(body))
 	}
 
 	var response struct {
-		Response string `json:"response"`
+		Response        string `json:"response"`
+		PromptEvalCount int    `json:"prompt_eval_count"`
+		EvalCount       int    `json:"eval_count"`
+		TotalDuration   int64  `json:"total_duration"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-		return "", fmt.Errorf("decode response failed: %w", err)
+		return "", types.Usage{}, fmt.Errorf("decode response failed: %w", err)
 	}
 
-	return response.Response, nil
+	usage := types.Usage{
+		Requests:         1,
+		PromptTokens:     response.PromptEvalCount,
+		CompletionTokens: response.EvalCount,
+		Duration:         time.Duration(response.TotalDuration),
+	}
+	if usage.Duration == 0 {
+		// Older servers do not report durations; fall back to wall time.
+		usage.Duration = time.Since(start)
+	}
+	return response.Response, usage, nil
 }
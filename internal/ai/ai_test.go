@@ -0,0 +1,64 @@
+package ai
+
+import (
+	"context"
+	"deeprefactor/internal/ai/fake"
+	"deeprefactor/internal/types"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	original = "package a\n\nfunc A() {}\n\nfunc B() {}\n\nfunc C() {}\n"
+	fixed    = "package a\n\n// A does a.\nfunc A() {}\n\nfunc B() {}\n\nfunc C() {}\n"
+)
+
+// fixWhileEditing runs FixFile on a file holding original and replaces its
+// content with edited while the model is answering.
+func fixWhileEditing(t *testing.T, edited string) (string, error) {
+	t.Helper()
+	server := fake.New(fake.Rule{Responses: []fake.Response{{Text: "```go\n" + fixed + "```", Delay: 300 * time.Millisecond}}})
+	defer server.Close()
+	path := filepath.Join(t.TempDir(), "a.go")
+	if err := os.WriteFile(path, []byte(original), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for len(server.Requests()) == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		os.WriteFile(path, []byte(edited), 0644)
+	}()
+	client := NewClient(server.URL, "m")
+	client.Annotation = "none"
+	updates := make(chan types.FileUpdate, 100)
+	_, _, err := client.FixFile(context.Background(), path, "a.go:3:1: missing doc", updates)
+	got, _ := os.ReadFile(path)
+	return string(got), err
+}
+
+func TestFixFileMergesConcurrentEdits(t *testing.T) {
+	got, err := fixWhileEditing(t, "package a\n\nfunc A() {}\n\nfunc B() {}\n\nfunc C() { println() }\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "package a\n\n// A does a.\nfunc A() {}\n\nfunc B() {}\n\nfunc C() { println() }\n"
+	if got != want {
+		t.Errorf("file = %q, want %q", got, want)
+	}
+}
+
+func TestFixFileConflict(t *testing.T) {
+	edited := "package a\n\n// A is edited.\nfunc A() {}\n\nfunc B() {}\n\nfunc C() {}\n"
+	got, err := fixWhileEditing(t, edited)
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("err = %v, want ErrConflict", err)
+	}
+	if got != edited {
+		t.Errorf("conflicting fix overwrote the edits: %q", got)
+	}
+}
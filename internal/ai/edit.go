@@ -0,0 +1,50 @@
+package ai
+
+import (
+	"deeprefactor/internal/backup"
+	"deeprefactor/internal/diff"
+	"deeprefactor/pkg/utils"
+	"fmt"
+	"os"
+)
+
+// Edit is a change to a file: After was derived from Before, the content
+// the change was based on.
+type Edit struct {
+	Path   string
+	Before string
+	After  string
+}
+
+// Write puts the edit on disk. If the file no longer holds Before, apart
+// from the line endings and BOM that SafeWriteFile keeps, the changes made
+// to it since are merged with the edit line by line, and ErrConflict is
+// returned when they overlap. It reports whether a merge was needed. The
+// original is saved to b before the first write.
+func (e Edit) Write(b *backup.Run) (merged bool, err error) {
+	current, err := os.ReadFile(e.Path)
+	if err != nil {
+		return false, fmt.Errorf("read file: %w", err)
+	}
+	content := e.After
+	if !utils.SameContent(current, []byte(e.Before)) {
+		var ok bool
+		content, ok = diff.Merge3(e.Before, e.After, string(current))
+		if !ok {
+			return false, fmt.Errorf("%w: the edits overlap the lines being changed", ErrConflict)
+		}
+		merged = true
+	}
+	if err := b.Save(e.Path); err != nil {
+		return merged, err
+	}
+	if err := utils.SafeWriteFile(e.Path, content); err != nil {
+		return merged, fmt.Errorf("write file: %w", err)
+	}
+	return merged, nil
+}
+
+// Revert undoes the edit, keeping any changes made to the file since.
+func (e Edit) Revert(b *backup.Run) (merged bool, err error) {
+	return Edit{Path: e.Path, Before: e.After, After: e.Before}.Write(b)
+}
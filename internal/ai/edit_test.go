@@ -0,0 +1,58 @@
+package ai
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRevertKeepsLaterEdits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.go")
+	edited := "package a\n\n// A does a.\nfunc A() {}\n\nfunc B() {}\n\nfunc C() { println() }\n"
+	if err := os.WriteFile(path, []byte(edited), 0644); err != nil {
+		t.Fatal(err)
+	}
+	merged, err := Edit{Path: path, Before: original, After: fixed}.Revert(nil)
+	if err != nil || !merged {
+		t.Fatalf("Revert = %v, %v", merged, err)
+	}
+	want := "package a\n\nfunc A() {}\n\nfunc B() {}\n\nfunc C() { println() }\n"
+	if got, _ := os.ReadFile(path); string(got) != want {
+		t.Errorf("file = %q, want %q", got, want)
+	}
+}
+
+func TestRevertCRLF(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.go")
+	crlf := strings.ReplaceAll(original, "\n", "\r\n")
+	if err := os.WriteFile(path, []byte(crlf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The model answers with LF, which is written back as CRLF.
+	edit := Edit{Path: path, Before: crlf, After: fixed}
+	if merged, err := edit.Write(nil); err != nil || merged {
+		t.Fatalf("Write = %v, %v", merged, err)
+	}
+	if merged, err := edit.Revert(nil); err != nil || merged {
+		t.Fatalf("Revert = %v, %v", merged, err)
+	}
+	if got, _ := os.ReadFile(path); string(got) != crlf {
+		t.Errorf("file = %q, want %q", got, crlf)
+	}
+}
+
+func TestRevertConflict(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.go")
+	edited := "package a\n\n// A does a, and more.\nfunc A() {}\n\nfunc B() {}\n\nfunc C() {}\n"
+	if err := os.WriteFile(path, []byte(edited), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (Edit{Path: path, Before: original, After: fixed}).Revert(nil); !errors.Is(err, ErrConflict) {
+		t.Fatalf("err = %v, want ErrConflict", err)
+	}
+	if got, _ := os.ReadFile(path); string(got) != edited {
+		t.Errorf("conflicting revert overwrote the edits: %q", got)
+	}
+}
@@ -0,0 +1,243 @@
+// Package fake provides a scripted LLM server for tests. It implements the
+// non-streaming Ollama generate and chat endpoints and the OpenAI-compatible
+// chat completions endpoint, answering each prompt from a list of rules.
+package fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Response is one scripted reply.
+type Response struct {
+	// Text is the model output.
+	Text string
+	// Status is the HTTP status code; zero means 200. Any other status
+	// returns Text as the error body.
+	Status int
+	// Delay holds the reply back, for timeouts and cancellation.
+	Delay time.Duration
+	// PromptTokens and CompletionTokens are reported as usage. When zero,
+	// they are estimated from the text at four bytes per token.
+	PromptTokens     int
+	CompletionTokens int
+}
+
+// Code returns a response holding src in a Go code block, the way models
+// are asked to answer.
+func Code(src string) Response {
+	return Response{Text: "Here is the fixed code:\n\n```go\n" + src + "\n```\n"}
+}
+
+// Broken returns a response without a code block.
+func Broken() Response {
+	return Response{Text: "I am sorry, I cannot help with that."}
+}
+
+// Error returns a response failing with status.
+func Error(status int, body string) Response {
+	return Response{Status: status, Text: body}
+}
+
+// Rule answers the prompts containing Match, or every prompt when Match is
+// empty, with Responses in turn. The last response repeats once the others
+// are used up.
+type Rule struct {
+	Match     string
+	Responses []Response
+}
+
+// Request is a prompt received by the server.
+type Request struct {
+	// API is "generate", "chat" or "openai".
+	API    string
+	Model  string
+	Prompt string
+}
+
+// Server is a scripted LLM server. Rules are tried in order and the first
+// match answers; prompts that match no rule get a 500 error.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	rules    []Rule
+	used     []int
+	requests []Request
+}
+
+// New starts a server answering with rules. Close it when done.
+func New(rules ...Rule) *Server {
+	s := &Server{rules: rules, used: make([]int, len(rules))}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/generate", s.handleGenerate)
+	mux.HandleFunc("/api/chat", s.handleChat)
+	mux.HandleFunc("/v1/chat/completions", s.handleOpenAI)
+	mux.HandleFunc("/api/tags", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{"models": []any{}})
+	})
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Requests returns the prompts received so far.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// next records the request and picks the scripted response.
+func (s *Server) next(req Request) (Response, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, req)
+	for i, rule := range s.rules {
+		if !strings.Contains(req.Prompt, rule.Match) || len(rule.Responses) == 0 {
+			continue
+		}
+		n := min(s.used[i], len(rule.Responses)-1)
+		s.used[i]++
+		return rule.Responses[n], true
+	}
+	return Response{}, false
+}
+
+// respond handles the parts common to every API and reports whether the
+// caller should write a successful reply.
+func (s *Server) respond(w http.ResponseWriter, r *http.Request, req Request) (Response, bool) {
+	resp, ok := s.next(req)
+	if !ok {
+		http.Error(w, fmt.Sprintf("no scripted response for prompt %.80q", req.Prompt), http.StatusInternalServerError)
+		return resp, false
+	}
+	if resp.Delay > 0 {
+		select {
+		case <-time.After(resp.Delay):
+		case <-r.Context().Done():
+			return resp, false
+		}
+	}
+	if resp.Status != 0 && resp.Status != http.StatusOK {
+		http.Error(w, resp.Text, resp.Status)
+		return resp, false
+	}
+	if resp.PromptTokens == 0 {
+		resp.PromptTokens = len(req.Prompt)/4 + 1
+	}
+	if resp.CompletionTokens == 0 {
+		resp.CompletionTokens = len(resp.Text)/4 + 1
+	}
+	return resp, true
+}
+
+func (s *Server) handleGenerate(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Model  string `json:"model"`
+		Prompt string `json:"prompt"`
+	}
+	if !decode(w, r, &body) {
+		return
+	}
+	start := time.Now()
+	resp, ok := s.respond(w, r, Request{API: "generate", Model: body.Model, Prompt: body.Prompt})
+	if !ok {
+		return
+	}
+	writeJSON(w, map[string]any{
+		"model":             body.Model,
+		"response":          resp.Text,
+		"done":              true,
+		"prompt_eval_count": resp.PromptTokens,
+		"eval_count":        resp.CompletionTokens,
+		"total_duration":    time.Since(start).Nanoseconds(),
+	})
+}
+
+type message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+func (s *Server) handleChat(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Model    string    `json:"model"`
+		Messages []message `json:"messages"`
+	}
+	if !decode(w, r, &body) {
+		return
+	}
+	start := time.Now()
+	resp, ok := s.respond(w, r, Request{API: "chat", Model: body.Model, Prompt: joinMessages(body.Messages)})
+	if !ok {
+		return
+	}
+	writeJSON(w, map[string]any{
+		"model":             body.Model,
+		"message":           message{Role: "assistant", Content: resp.Text},
+		"done":              true,
+		"prompt_eval_count": resp.PromptTokens,
+		"eval_count":        resp.CompletionTokens,
+		"total_duration":    time.Since(start).Nanoseconds(),
+	})
+}
+
+func (s *Server) handleOpenAI(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Model    string    `json:"model"`
+		Messages []message `json:"messages"`
+	}
+	if !decode(w, r, &body) {
+		return
+	}
+	resp, ok := s.respond(w, r, Request{API: "openai", Model: body.Model, Prompt: joinMessages(body.Messages)})
+	if !ok {
+		return
+	}
+	writeJSON(w, map[string]any{
+		"id":      "chatcmpl-fake",
+		"object":  "chat.completion",
+		"created": time.Now().Unix(),
+		"model":   body.Model,
+		"choices": []any{map[string]any{
+			"index":         0,
+			"message":       message{Role: "assistant", Content: resp.Text},
+			"finish_reason": "stop",
+		}},
+		"usage": map[string]int{
+			"prompt_tokens":     resp.PromptTokens,
+			"completion_tokens": resp.CompletionTokens,
+			"total_tokens":      resp.PromptTokens + resp.CompletionTokens,
+		},
+	})
+}
+
+func joinMessages(messages []message) string {
+	parts := make([]string, len(messages))
+	for i, m := range messages {
+		parts[i] = m.Content
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+func decode(w http.ResponseWriter, r *http.Request, v any) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,90 @@
+package fake
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func post(t *testing.T, url string, body any) (int, map[string]any) {
+	t.Helper()
+	data, _ := json.Marshal(body)
+	resp, err := http.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	raw, _ := io.ReadAll(resp.Body)
+	var out map[string]any
+	json.Unmarshal(raw, &out)
+	return resp.StatusCode, out
+}
+
+func TestRulesAnswerInOrder(t *testing.T) {
+	s := New(
+		Rule{Match: "a.go", Responses: []Response{{Text: "first"}, {Text: "second"}}},
+		Rule{Responses: []Response{{Text: "fallback"}}},
+	)
+	defer s.Close()
+
+	var got []string
+	for _, prompt := range []string{"fix a.go", "fix b.go", "fix a.go", "fix a.go"} {
+		_, out := post(t, s.URL+"/api/generate", map[string]any{"model": "m", "prompt": prompt})
+		got = append(got, out["response"].(string))
+	}
+	want := "first fallback second second"
+	if strings.Join(got, " ") != want {
+		t.Errorf("responses = %q, want %q", strings.Join(got, " "), want)
+	}
+	if n := len(s.Requests()); n != 4 {
+		t.Errorf("recorded %d requests, want 4", n)
+	}
+}
+
+func TestAPIs(t *testing.T) {
+	s := New(Rule{Responses: []Response{{Text: "hello", PromptTokens: 7, CompletionTokens: 3}}})
+	defer s.Close()
+
+	_, gen := post(t, s.URL+"/api/generate", map[string]any{"model": "m", "prompt": "p"})
+	if gen["response"] != "hello" || gen["eval_count"] != 3.0 || gen["prompt_eval_count"] != 7.0 {
+		t.Errorf("generate = %v", gen)
+	}
+
+	messages := []map[string]string{{"role": "user", "content": "p"}}
+	_, chat := post(t, s.URL+"/api/chat", map[string]any{"model": "m", "messages": messages})
+	if msg, _ := chat["message"].(map[string]any); msg["content"] != "hello" {
+		t.Errorf("chat = %v", chat)
+	}
+
+	_, openai := post(t, s.URL+"/v1/chat/completions", map[string]any{"model": "m", "messages": messages})
+	choices, _ := openai["choices"].([]any)
+	if len(choices) != 1 || choices[0].(map[string]any)["message"].(map[string]any)["content"] != "hello" {
+		t.Errorf("openai = %v", openai)
+	}
+	if usage, _ := openai["usage"].(map[string]any); usage["total_tokens"] != 10.0 {
+		t.Errorf("openai usage = %v", openai["usage"])
+	}
+
+	var apis []string
+	for _, r := range s.Requests() {
+		apis = append(apis, r.API)
+	}
+	if got := strings.Join(apis, ","); got != "generate,chat,openai" {
+		t.Errorf("APIs = %s", got)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	s := New(Rule{Match: "boom", Responses: []Response{Error(http.StatusServiceUnavailable, "overloaded")}})
+	defer s.Close()
+
+	if status, _ := post(t, s.URL+"/api/generate", map[string]any{"prompt": "boom"}); status != http.StatusServiceUnavailable {
+		t.Errorf("scripted error status = %d", status)
+	}
+	if status, _ := post(t, s.URL+"/api/generate", map[string]any{"prompt": "other"}); status != http.StatusInternalServerError {
+		t.Errorf("unmatched prompt status = %d", status)
+	}
+}
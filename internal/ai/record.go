@@ -0,0 +1,201 @@
+package ai
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Interaction is one recorded request to the model server and its reply.
+type Interaction struct {
+	Sequence int       `json:"sequence"`
+	Time     time.Time `json:"time"`
+	Method   string    `json:"method"`
+	URL      string    `json:"url"`
+	// Key identifies the request for replay; see interactionKey.
+	Key      string        `json:"key"`
+	Model    string        `json:"model,omitempty"`
+	Prompt   string        `json:"prompt,omitempty"`
+	Request  string        `json:"request"`
+	Status   int           `json:"status"`
+	Response string        `json:"response"`
+	Duration time.Duration `json:"duration_ns"`
+}
+
+// interactionKey hashes the method, path and body of a request. The host is
+// left out so a recording can be replayed against any server URL.
+func interactionKey(method, path string, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", method, path)
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// readBody drains and replaces the body of req so it can be sent again.
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// Recorder is an http.RoundTripper that saves every interaction as a JSON
+// file in Dir.
+type Recorder struct {
+	Dir  string
+	Base http.RoundTripper
+
+	mu  sync.Mutex
+	seq int
+}
+
+// NewRecorder creates dir and returns a Recorder sending requests through
+// base, or http.DefaultTransport when base is nil.
+func NewRecorder(dir string, base http.RoundTripper) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create recording directory: %w", err)
+	}
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	existing, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	return &Recorder{Dir: dir, Base: base, seq: len(existing)}, nil
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	resp, err := r.Base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+
+	var fields struct {
+		Model  string `json:"model"`
+		Prompt string `json:"prompt"`
+	}
+	json.Unmarshal(body, &fields)
+
+	r.mu.Lock()
+	r.seq++
+	seq := r.seq
+	r.mu.Unlock()
+
+	in := Interaction{
+		Sequence: seq,
+		Time:     start,
+		Method:   req.Method,
+		URL:      req.URL.String(),
+		Key:      interactionKey(req.Method, req.URL.Path, body),
+		Model:    fields.Model,
+		Prompt:   fields.Prompt,
+		Request:  string(body),
+		Status:   resp.StatusCode,
+		Response: string(respBody),
+		Duration: time.Since(start),
+	}
+	data, err := json.MarshalIndent(in, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Join(r.Dir, fmt.Sprintf("%04d-%s.json", seq, in.Key[:12]))
+	if err := os.WriteFile(name, data, 0644); err != nil {
+		return nil, fmt.Errorf("record interaction: %w", err)
+	}
+	return resp, nil
+}
+
+// Replayer is an http.RoundTripper that answers requests from a recording
+// made by Recorder without touching the network. Identical requests get the
+// recorded replies in sequence order, and the last one repeats.
+type Replayer struct {
+	mu      sync.Mutex
+	byKey   map[string][]Interaction
+	replays map[string]int
+}
+
+// NewReplayer loads the recording in dir.
+func NewReplayer(dir string) (*Replayer, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no recorded interactions in %s", dir)
+	}
+	r := &Replayer{byKey: make(map[string][]Interaction), replays: make(map[string]int)}
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		var in Interaction
+		if err := json.Unmarshal(data, &in); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", f, err)
+		}
+		r.byKey[in.Key] = append(r.byKey[in.Key], in)
+	}
+	for _, list := range r.byKey {
+		sort.Slice(list, func(i, j int) bool { return list[i].Sequence < list[j].Sequence })
+	}
+	return r, nil
+}
+
+// ErrNotRecorded is returned for requests missing from the recording.
+var ErrNotRecorded = errors.New("request not found in recording")
+
+func (r *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+	key := interactionKey(req.Method, req.URL.Path, body)
+
+	r.mu.Lock()
+	list := r.byKey[key]
+	n := r.replays[key]
+	r.replays[key]++
+	r.mu.Unlock()
+
+	if len(list) == 0 {
+		return nil, fmt.Errorf("%w (key %s)", ErrNotRecorded, key[:12])
+	}
+	in := list[min(n, len(list)-1)]
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", in.Status, http.StatusText(in.Status)),
+		StatusCode:    in.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          io.NopCloser(strings.NewReader(in.Response)),
+		ContentLength: int64(len(in.Response)),
+		Request:       req,
+	}, nil
+}
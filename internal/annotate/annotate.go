@@ -0,0 +1,140 @@
+// Package annotate controls the [DeepRefactor] comments that mark changes
+// made by the model.
+package annotate
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"sort"
+	"strings"
+)
+
+// Marker identifies comments written for DeepRefactor.
+const Marker = "[DeepRefactor]"
+
+// Annotation policies.
+const (
+	// None removes every marker from the model's output.
+	None = "none"
+	// Inline keeps the markers the model puts on changed lines.
+	Inline = "inline"
+	// Summary keeps a single marker after the package clause.
+	Summary = "summary"
+)
+
+// Instruction tells the model how to annotate its changes under policy.
+func Instruction(policy string) string {
+	switch policy {
+	case None:
+		return "Do not add comments that describe your changes."
+	case Summary:
+		return "Do not comment individual changes. Instead add one // " + Marker + " comment right after the package clause that summarizes all changes."
+	default:
+		return "Mark each line you change with a // " + Marker + " comment that explains the change."
+	}
+}
+
+// Apply enforces policy on src, the code returned by the model. Under
+// Summary, the first marker text becomes the summary; if there is none a
+// generic one is used.
+func Apply(policy string, src []byte) ([]byte, error) {
+	if policy == Inline || policy == "" {
+		return src, nil
+	}
+	out, removed, err := Strip(src)
+	if err != nil || policy == None {
+		return out, err
+	}
+
+	summary := "automated fixes"
+	if len(removed) > 0 {
+		summary = removed[0]
+	}
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "", out, parser.PackageClauseOnly)
+	if err != nil {
+		return nil, err
+	}
+	// Insert after the line holding the package clause.
+	end := fset.Position(file.Name.End()).Offset
+	if nl := bytes.IndexByte(out[end:], '\n'); nl >= 0 {
+		end += nl + 1
+	} else {
+		out = append(out, '\n')
+		end = len(out)
+	}
+	comment := fmt.Sprintf("\n// %s %s\n", Marker, summary)
+	return append(out[:end:end], append([]byte(comment), out[end:]...)...), nil
+}
+
+// Strip removes the comments containing Marker from src and returns the
+// marker texts, without the comment syntax and the marker itself. A marker
+// on its own line removes the line; a trailing marker removes the comment
+// and the whitespace before it.
+func Strip(src []byte) ([]byte, []string, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "", src, parser.ParseComments|parser.SkipObjectResolution)
+	if err != nil {
+		return src, nil, err
+	}
+
+	type span struct{ start, end int }
+	var spans []span
+	var texts []string
+	// The comment map also holds comments that are not attached to a node,
+	// such as ones between declarations.
+	cmap := ast.NewCommentMap(fset, file, file.Comments)
+	for _, group := range cmap.Comments() {
+		for _, c := range group.List {
+			if !strings.Contains(c.Text, Marker) {
+				continue
+			}
+			start := fset.Position(c.Pos()).Offset
+			end := fset.Position(c.End()).Offset
+			lineStart := bytes.LastIndexByte(src[:start], '\n') + 1
+			lineEnd := len(src)
+			if nl := bytes.IndexByte(src[end:], '\n'); nl >= 0 {
+				lineEnd = end + nl
+			}
+			before := bytes.TrimSpace(src[lineStart:start])
+			after := bytes.TrimSpace(src[end:lineEnd])
+			switch {
+			case len(before) == 0 && len(after) == 0:
+				start, end = lineStart, min(lineEnd+1, len(src))
+			case len(after) == 0:
+				start = lineStart + len(bytes.TrimRight(src[lineStart:start], " \t"))
+			}
+			spans = append(spans, span{start, end})
+			texts = append(texts, markerText(c.Text))
+		}
+	}
+	if len(spans) == 0 {
+		return src, nil, nil
+	}
+
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+	var out bytes.Buffer
+	last := 0
+	for _, s := range spans {
+		if s.start < last {
+			continue
+		}
+		out.Write(src[last:s.start])
+		last = s.end
+	}
+	out.Write(src[last:])
+	return out.Bytes(), texts, nil
+}
+
+// markerText returns the text of a marker comment after the marker.
+func markerText(comment string) string {
+	text := strings.TrimPrefix(comment, "//")
+	text = strings.TrimSuffix(strings.TrimPrefix(text, "/*"), "*/")
+	if _, rest, ok := strings.Cut(text, Marker); ok {
+		text = rest
+	}
+	return strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(text), ":-"))
+}
@@ -0,0 +1,38 @@
+package annotate
+
+import "testing"
+
+const code = "package main\n\n// [DeepRefactor] fixed the loop\nfunc main() {\n\tx := 1 // [DeepRefactor] renamed\n\t_ = x // keep\n}\n"
+
+func TestStrip(t *testing.T) {
+	got, texts, err := Strip([]byte(code))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "package main\n\nfunc main() {\n\tx := 1\n\t_ = x // keep\n}\n"
+	if string(got) != want {
+		t.Errorf("Strip = %q, want %q", got, want)
+	}
+	if len(texts) != 2 || texts[0] != "fixed the loop" || texts[1] != "renamed" {
+		t.Errorf("texts = %q", texts)
+	}
+}
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		policy, want string
+	}{
+		{Inline, code},
+		{None, "package main\n\nfunc main() {\n\tx := 1\n\t_ = x // keep\n}\n"},
+		{Summary, "package main\n\n// [DeepRefactor] fixed the loop\n\nfunc main() {\n\tx := 1\n\t_ = x // keep\n}\n"},
+	}
+	for _, tt := range tests {
+		got, err := Apply(tt.policy, []byte(code))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("Apply(%s) = %q, want %q", tt.policy, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,710 @@
+// Package api is an HTTP/JSON front-end for fix jobs. Clients submit a
+// directory or file contents, follow the job's FileUpdate events over
+// Server-Sent Events, fetch diffs and accept or reject the results.
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"deeprefactor/internal/diff"
+	"deeprefactor/internal/types"
+	"deeprefactor/pkg/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Runner runs the fix loop for the server.
+type Runner interface {
+	// Files lists the Go files to fix under dir.
+	Files(dir string) ([]*types.FileProcess, error)
+	// FixFiles runs the fix loop over files on disk, sending progress to
+	// updates and closing it when every file is done.
+	FixFiles(files []*types.FileProcess, updates chan<- types.FileUpdate)
+	// FixContent returns content with the problems in lintOutput fixed,
+	// without touching the disk. Model usage is reported in updates.
+	FixContent(ctx context.Context, path, content, lintOutput string, updates chan<- types.FileUpdate) (string, error)
+}
+
+// Job states.
+const (
+	Running = "running"
+	Done    = "done"
+)
+
+// Decisions on the result of a file.
+const (
+	Accepted = "accepted"
+	Rejected = "rejected"
+)
+
+// JobRequest submits a job: either a directory to fix in place or file
+// contents with their lint output.
+type JobRequest struct {
+	// Dir is relative to the served root.
+	Dir   string        `json:"dir,omitempty"`
+	Files []FileRequest `json:"files,omitempty"`
+}
+
+// FileRequest is a file submitted by content.
+type FileRequest struct {
+	Path       string `json:"path"`
+	Content    string `json:"content"`
+	LintOutput string `json:"lint_output"`
+}
+
+// DecisionRequest selects the files to accept or reject. No paths means
+// every file of the job.
+type DecisionRequest struct {
+	Paths []string `json:"paths,omitempty"`
+}
+
+// Job is the JSON view of a job.
+type Job struct {
+	ID       string     `json:"id"`
+	Kind     string     `json:"kind"`
+	Dir      string     `json:"dir,omitempty"`
+	State    string     `json:"state"`
+	Created  time.Time  `json:"created"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Files    []File     `json:"files"`
+}
+
+// File is the JSON view of a file in a job.
+type File struct {
+	Path        string             `json:"path"`
+	Status      string             `json:"status"`
+	Retries     int                `json:"retries"`
+	Diagnostics []types.Diagnostic `json:"diagnostics"`
+	Usage       types.Usage        `json:"usage"`
+	Changed     bool               `json:"changed"`
+	Decision    string             `json:"decision,omitempty"`
+	// Result is the fixed content of a file submitted by content. Fixes
+	// of directory jobs are on disk.
+	Result string `json:"result,omitempty"`
+}
+
+// Decision is the outcome of accepting or rejecting one file.
+type Decision struct {
+	Path     string `json:"path"`
+	Decision string `json:"decision,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+type jobFile struct {
+	proc     *types.FileProcess
+	original string
+	result   string
+	decision string
+}
+
+type job struct {
+	id      string
+	kind    string
+	dir     string
+	created time.Time
+
+	mu       sync.Mutex
+	files    []*jobFile
+	byPath   map[string]*jobFile
+	events   []types.FileUpdate
+	finished time.Time
+	// wake is closed and replaced whenever an event is added or the job
+	// finishes, to wake the event streams.
+	wake chan struct{}
+}
+
+// Server holds the jobs of one serve process.
+type Server struct {
+	root   string
+	runner Runner
+	token  string
+	host   string
+
+	mu     sync.Mutex
+	jobs   map[string]*job
+	nextID int
+	// busy holds the files on disk that a running job is fixing.
+	busy map[string]bool
+}
+
+// NewServer serves jobs for the directories under root. A non-empty token
+// is required as a bearer token on every request. Requests must address
+// localhost, an IP address or host, the name the server listens on, so a
+// web page cannot reach the server by rebinding its own domain name.
+func NewServer(root string, runner Runner, token, host string) *Server {
+	return &Server{
+		root:   root,
+		runner: runner,
+		token:  token,
+		host:   host,
+		jobs:   make(map[string]*job),
+		busy:   make(map[string]bool),
+	}
+}
+
+// Handler returns the routes of the API.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /jobs", s.createJob)
+	mux.HandleFunc("GET /jobs", s.listJobs)
+	mux.HandleFunc("GET /jobs/{id}", s.getJob)
+	mux.HandleFunc("GET /jobs/{id}/events", s.streamEvents)
+	mux.HandleFunc("GET /jobs/{id}/diff", s.getDiff)
+	mux.HandleFunc("POST /jobs/{id}/accept", s.decide(Accepted))
+	mux.HandleFunc("POST /jobs/{id}/reject", s.decide(Rejected))
+	return s.authorize(mux)
+}
+
+func (s *Server) authorize(next http.Handler) http.Handler {
+	want := []byte("Bearer " + s.token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.allowedHost(r.Host) {
+			writeError(w, http.StatusForbidden, fmt.Errorf("host %q is not served", r.Host))
+			return
+		}
+		if s.token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("missing or wrong bearer token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowedHost reports whether a request for host may be served. IP
+// addresses are allowed since only domain names can be rebound.
+func (s *Server) allowedHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(host, ".")
+	if strings.EqualFold(host, "localhost") || net.ParseIP(host) != nil {
+		return true
+	}
+	return s.host != "" && strings.EqualFold(host, s.host)
+}
+
+func (s *Server) createJob(w http.ResponseWriter, r *http.Request) {
+	var req JobRequest
+	if err := readJSON(w, r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var (
+		j      *job
+		status int
+		err    error
+	)
+	switch {
+	case req.Dir != "" && len(req.Files) > 0:
+		status, err = http.StatusBadRequest, errors.New("give either dir or files, not both")
+	case len(req.Files) > 0:
+		j, status, err = s.startContentJob(req.Files)
+	default:
+		j, status, err = s.startDirJob(req.Dir)
+	}
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+	w.Header().Set("Location", "/jobs/"+j.id)
+	writeJSON(w, http.StatusCreated, j.view())
+}
+
+func (s *Server) newJob(kind, dir string) *job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	j := &job{
+		id:      strconv.Itoa(s.nextID),
+		kind:    kind,
+		dir:     dir,
+		created: time.Now(),
+		byPath:  make(map[string]*jobFile),
+		wake:    make(chan struct{}),
+	}
+	s.jobs[j.id] = j
+	return j
+}
+
+func (s *Server) startDirJob(rel string) (*job, int, error) {
+	dir, err := s.resolve(rel)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	files, err := s.runner.Files(dir)
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("finding Go files: %w", err)
+	}
+	if len(files) == 0 {
+		return nil, http.StatusBadRequest, fmt.Errorf("no Go files in %s", rel)
+	}
+
+	// Two jobs fixing the same file would overwrite each other.
+	s.mu.Lock()
+	for _, f := range files {
+		if s.busy[f.Path] {
+			s.mu.Unlock()
+			return nil, http.StatusConflict, fmt.Errorf("%s is being fixed by another job", f.Path)
+		}
+	}
+	for _, f := range files {
+		s.busy[f.Path] = true
+	}
+	s.mu.Unlock()
+
+	if rel == "" {
+		rel = "."
+	}
+	j := s.newJob("dir", filepath.ToSlash(rel))
+	for _, f := range files {
+		j.add(&jobFile{proc: f})
+	}
+
+	updates := make(chan types.FileUpdate, 100)
+	go s.runner.FixFiles(files, updates)
+	go func() {
+		for u := range updates {
+			j.apply(u)
+		}
+		j.mu.Lock()
+		for _, f := range j.files {
+			f.proc.Mutex.Lock()
+			f.original = f.proc.Original
+			f.proc.Mutex.Unlock()
+			if data, err := os.ReadFile(f.proc.Path); err == nil {
+				f.result = string(data)
+			} else {
+				f.result = f.original
+			}
+			if f.original == "" {
+				// The fix loop stopped before reading the file, so it was
+				// not changed and there is nothing to restore.
+				f.original = f.result
+			}
+		}
+		j.mu.Unlock()
+
+		s.mu.Lock()
+		for _, f := range files {
+			delete(s.busy, f.Path)
+		}
+		s.mu.Unlock()
+		j.finish()
+	}()
+	return j, http.StatusCreated, nil
+}
+
+func (s *Server) startContentJob(reqs []FileRequest) (*job, int, error) {
+	seen := make(map[string]bool)
+	for _, f := range reqs {
+		if f.Path == "" {
+			return nil, http.StatusBadRequest, errors.New("every file needs a path")
+		}
+		if seen[f.Path] {
+			return nil, http.StatusBadRequest, fmt.Errorf("%s is given twice", f.Path)
+		}
+		seen[f.Path] = true
+	}
+
+	j := s.newJob("content", "")
+	for _, f := range reqs {
+		j.add(&jobFile{
+			proc:     &types.FileProcess{Path: f.Path, Status: "Pending", Original: f.Content},
+			original: f.Content,
+			result:   f.Content,
+		})
+	}
+
+	updates := make(chan types.FileUpdate, 100)
+	var wg sync.WaitGroup
+	for _, f := range reqs {
+		wg.Add(1)
+		go func(f FileRequest) {
+			defer wg.Done()
+			s.fixContent(j, f, updates)
+		}(f)
+	}
+	go func() {
+		wg.Wait()
+		close(updates)
+	}()
+	go func() {
+		for u := range updates {
+			j.apply(u)
+		}
+		j.finish()
+	}()
+	return j, http.StatusCreated, nil
+}
+
+// fixContent makes a single fix attempt with the lint output the client
+// sent, since the file cannot be checked again without its package.
+func (s *Server) fixContent(j *job, f FileRequest, updates chan<- types.FileUpdate) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	updates <- types.FileUpdate{Path: f.Path, Status: "Attempt 1/1"}
+	if strings.TrimSpace(f.LintOutput) == "" {
+		updates <- types.FileUpdate{Path: f.Path, Status: "Fixed", Log: "No lint output, nothing to fix"}
+		return
+	}
+	fixed, err := s.runner.FixContent(ctx, f.Path, f.Content, f.LintOutput, updates)
+	if err != nil {
+		updates <- types.FileUpdate{Path: f.Path, Status: "Failed", Log: fmt.Sprintf("Fix error: %v", err)}
+		return
+	}
+	j.mu.Lock()
+	j.byPath[f.Path].result = fixed
+	j.mu.Unlock()
+	updates <- types.FileUpdate{Path: f.Path, Status: "Fixed"}
+}
+
+// resolve returns the directory rel names under the root, refusing paths
+// that leave it, also through symbolic links.
+func (s *Server) resolve(rel string) (string, error) {
+	if filepath.IsAbs(rel) {
+		return "", fmt.Errorf("dir %q must be relative to the served directory", rel)
+	}
+	clean := filepath.Clean(filepath.FromSlash(rel))
+	if clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("dir %q is outside the served directory", rel)
+	}
+	dir := filepath.Join(s.root, clean)
+	info, err := os.Stat(dir)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", rel)
+	}
+	root, err := filepath.EvalSymlinks(s.root)
+	if err != nil {
+		return "", err
+	}
+	target, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+	if inside, err := filepath.Rel(root, target); err != nil || inside == ".." || strings.HasPrefix(inside, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("dir %q is outside the served directory", rel)
+	}
+	return dir, nil
+}
+
+func (s *Server) lookup(w http.ResponseWriter, r *http.Request) *job {
+	s.mu.Lock()
+	j := s.jobs[r.PathValue("id")]
+	s.mu.Unlock()
+	if j == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no job %q", r.PathValue("id")))
+	}
+	return j
+}
+
+func (s *Server) listJobs(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	jobs := make([]*job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		jobs = append(jobs, j)
+	}
+	s.mu.Unlock()
+	sort.Slice(jobs, func(a, b int) bool { return jobs[a].created.Before(jobs[b].created) })
+
+	views := make([]Job, 0, len(jobs))
+	for _, j := range jobs {
+		views = append(views, j.view())
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+func (s *Server) getJob(w http.ResponseWriter, r *http.Request) {
+	if j := s.lookup(w, r); j != nil {
+		writeJSON(w, http.StatusOK, j.view())
+	}
+}
+
+// streamEvents sends the job's updates as Server-Sent Events, starting
+// with those already recorded, and ends with a "done" event holding the
+// final job. The event ID is the update's index, so a reconnecting client
+// resumes after Last-Event-ID.
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request) {
+	j := s.lookup(w, r)
+	if j == nil {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming not supported"))
+		return
+	}
+	next := 0
+	if last, err := strconv.Atoi(r.Header.Get("Last-Event-ID")); err == nil && last >= 0 {
+		next = last + 1
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		j.mu.Lock()
+		pending := j.events[min(next, len(j.events)):]
+		done := !j.finished.IsZero()
+		wake := j.wake
+		j.mu.Unlock()
+
+		for _, u := range pending {
+			data, _ := json.Marshal(u)
+			fmt.Fprintf(w, "id: %d\nevent: update\ndata: %s\n\n", next, data)
+			next++
+		}
+		if done {
+			data, _ := json.Marshal(j.view())
+			fmt.Fprintf(w, "event: done\ndata: %s\n\n", data)
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-wake:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// getDiff returns a unified diff of the changed files, or of the file
+// given with ?path=.
+func (s *Server) getDiff(w http.ResponseWriter, r *http.Request) {
+	j := s.lookup(w, r)
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	files := j.files
+	if path := r.URL.Query().Get("path"); path != "" {
+		f := j.byPath[path]
+		if f == nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("%s is not part of job %s", path, j.id))
+			return
+		}
+		files = []*jobFile{f}
+	}
+	var sb strings.Builder
+	for _, f := range files {
+		original, result := f.original, f.result
+		if j.kind == "dir" && j.finished.IsZero() {
+			// The fix is still on its way to disk.
+			f.proc.Mutex.Lock()
+			original = f.proc.Original
+			f.proc.Mutex.Unlock()
+			if data, err := os.ReadFile(f.proc.Path); err == nil {
+				result = string(data)
+			} else {
+				result = original
+			}
+			if original == "" {
+				original = result
+			}
+		}
+		name := filepath.ToSlash(f.proc.Path)
+		sb.WriteString(diff.Unified("a/"+name, "b/"+name, original, result))
+	}
+	w.Header().Set("Content-Type", "text/x-diff; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(sb.String()))
+}
+
+// decide records a decision on finished files. Rejecting a file of a
+// directory job puts its original back, unless the file has changed since
+// the job wrote it.
+func (s *Server) decide(decision string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		j := s.lookup(w, r)
+		if j == nil {
+			return
+		}
+		var req DecisionRequest
+		if r.ContentLength != 0 {
+			if err := readJSON(w, r, &req); err != nil && !errors.Is(err, io.EOF) {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		if j.finished.IsZero() {
+			writeError(w, http.StatusConflict, fmt.Errorf("job %s is still running", j.id))
+			return
+		}
+		files := j.files
+		if len(req.Paths) > 0 {
+			files = nil
+			for _, p := range req.Paths {
+				f := j.byPath[p]
+				if f == nil {
+					writeError(w, http.StatusBadRequest, fmt.Errorf("%s is not part of job %s", p, j.id))
+					return
+				}
+				files = append(files, f)
+			}
+		}
+
+		status := http.StatusOK
+		results := make([]Decision, 0, len(files))
+		for _, f := range files {
+			res := Decision{Path: f.proc.Path}
+			if err := j.decideFile(f, decision); err != nil {
+				res.Error = err.Error()
+				status = http.StatusConflict
+			}
+			res.Decision = f.decision
+			results = append(results, res)
+		}
+		writeJSON(w, status, results)
+	}
+}
+
+// decideFile applies a decision to f. The caller must hold the job's
+// mutex.
+func (j *job) decideFile(f *jobFile, decision string) error {
+	if f.decision == decision {
+		return nil
+	}
+	if f.decision != "" {
+		return fmt.Errorf("already %s", f.decision)
+	}
+	if decision == Rejected && j.kind == "dir" && f.result != f.original {
+		info, err := os.Stat(f.proc.Path)
+		if err != nil {
+			return err
+		}
+		current, err := os.ReadFile(f.proc.Path)
+		if err != nil {
+			return err
+		}
+		if string(current) != f.result {
+			return errors.New("file changed since the fix, not restoring the original")
+		}
+		if err := utils.ReplaceFile(f.proc.Path, []byte(f.original), info.Mode().Perm()); err != nil {
+			return fmt.Errorf("restore original: %w", err)
+		}
+	}
+	f.decision = decision
+	return nil
+}
+
+func (j *job) add(f *jobFile) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.files = append(j.files, f)
+	j.byPath[f.proc.Path] = f
+}
+
+// apply records an update from the fix loop.
+func (j *job) apply(u types.FileUpdate) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	f := j.byPath[u.Path]
+	if f == nil {
+		return
+	}
+	f.proc.Mutex.Lock()
+	f.proc.Apply(u)
+	f.proc.Mutex.Unlock()
+	u.File = nil
+	j.events = append(j.events, u)
+	close(j.wake)
+	j.wake = make(chan struct{})
+}
+
+func (j *job) finish() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.finished = time.Now()
+	close(j.wake)
+	j.wake = make(chan struct{})
+}
+
+func (j *job) view() Job {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	v := Job{
+		ID:      j.id,
+		Kind:    j.kind,
+		Dir:     j.dir,
+		State:   Running,
+		Created: j.created,
+		Files:   make([]File, 0, len(j.files)),
+	}
+	done := !j.finished.IsZero()
+	if done {
+		v.State = Done
+		finished := j.finished
+		v.Finished = &finished
+	}
+	for _, f := range j.files {
+		f.proc.Mutex.Lock()
+		fv := File{
+			Path:        f.proc.Path,
+			Status:      f.proc.Status,
+			Retries:     f.proc.Retries,
+			Diagnostics: f.proc.Diagnostics,
+			Usage:       f.proc.Usage,
+			Decision:    f.decision,
+		}
+		f.proc.Mutex.Unlock()
+		if fv.Diagnostics == nil {
+			fv.Diagnostics = []types.Diagnostic{}
+		}
+		if done {
+			fv.Changed = f.result != f.original
+			if j.kind == "content" {
+				fv.Result = f.result
+			}
+		}
+		v.Files = append(v.Files, fv)
+	}
+	return v
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v any) error {
+	if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mt != "application/json" {
+		return errors.New("Content-Type must be application/json")
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 32<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("invalid request body: %w", err)
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
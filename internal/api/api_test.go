@@ -0,0 +1,345 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"deeprefactor/internal/types"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	source = "package a\n\nfunc f() {\n\tx := 1\n}\n"
+	fixed  = "package a\n\nfunc f() {\n}\n"
+)
+
+// fakeRunner removes the unused variable from every file. It waits for
+// release before fixing files on disk, so tests can look at a running job.
+type fakeRunner struct {
+	release chan struct{}
+}
+
+func (r fakeRunner) Files(dir string) ([]*types.FileProcess, error) {
+	var files []*types.FileProcess
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && strings.HasSuffix(path, ".go") {
+			files = append(files, &types.FileProcess{Path: path, Status: "Pending"})
+		}
+		return err
+	})
+	return files, err
+}
+
+func (r fakeRunner) FixFiles(files []*types.FileProcess, updates chan<- types.FileUpdate) {
+	defer close(updates)
+	<-r.release
+	for _, f := range files {
+		data, err := os.ReadFile(f.Path)
+		if err != nil {
+			updates <- types.FileUpdate{Path: f.Path, Status: "Failed", Log: err.Error()}
+			continue
+		}
+		f.Mutex.Lock()
+		f.Original = string(data)
+		f.Mutex.Unlock()
+		updates <- types.FileUpdate{Path: f.Path, Status: "Attempt 1/1"}
+		if err := os.WriteFile(f.Path, []byte(strings.Replace(string(data), "\tx := 1\n", "", 1)), 0644); err != nil {
+			updates <- types.FileUpdate{Path: f.Path, Status: "Failed", Log: err.Error()}
+			continue
+		}
+		updates <- types.FileUpdate{Path: f.Path, Status: "Fixed", Log: "Applied AI fix", Usage: types.Usage{Requests: 1, PromptTokens: 10}}
+	}
+}
+
+// failingRunner fails every file before reading it, the way the fix loop
+// does when it cannot start a backup run.
+type failingRunner struct {
+	fakeRunner
+}
+
+func (r failingRunner) FixFiles(files []*types.FileProcess, updates chan<- types.FileUpdate) {
+	for _, f := range files {
+		updates <- types.FileUpdate{Path: f.Path, Status: "Failed", Log: "backup: permission denied"}
+	}
+	close(updates)
+}
+
+func (r fakeRunner) FixContent(ctx context.Context, path, content, lintOutput string, updates chan<- types.FileUpdate) (string, error) {
+	if !strings.Contains(lintOutput, "declared and not used") {
+		return "", errors.New("no code block")
+	}
+	updates <- types.FileUpdate{Path: path, Log: "fixing", Usage: types.Usage{Requests: 1}}
+	return strings.Replace(content, "\tx := 1\n", "", 1), nil
+}
+
+func start(t *testing.T, token string) (*httptest.Server, string, chan struct{}) {
+	t.Helper()
+	release := make(chan struct{})
+	ts, root := serve(t, token, fakeRunner{release})
+	return ts, root, release
+}
+
+// serve starts a server for a temporary root holding pkg/a.go and pkg/b.go.
+func serve(t *testing.T, token string, runner Runner) (*httptest.Server, string) {
+	t.Helper()
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "pkg"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.go", "b.go"} {
+		if err := os.WriteFile(filepath.Join(root, "pkg", name), []byte(source), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ts := httptest.NewServer(NewServer(root, runner, token, "refactor.internal").Handler())
+	t.Cleanup(ts.Close)
+	return ts, root
+}
+
+func call(t *testing.T, ts *httptest.Server, method, path, body string, v any) int {
+	t.Helper()
+	req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != nil {
+		if err := json.Unmarshal(data, v); err != nil {
+			t.Fatalf("%s %s: %v\n%s", method, path, err, data)
+		}
+	}
+	return resp.StatusCode
+}
+
+// events reads the event stream of a job until its done event.
+func events(t *testing.T, ts *httptest.Server, id string) ([]types.FileUpdate, Job) {
+	t.Helper()
+	resp, err := ts.Client().Get(ts.URL + "/jobs/" + id + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+
+	var updates []types.FileUpdate
+	var event string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data := []byte(strings.TrimPrefix(line, "data: "))
+			if event == "done" {
+				var job Job
+				if err := json.Unmarshal(data, &job); err != nil {
+					t.Fatal(err)
+				}
+				return updates, job
+			}
+			var u types.FileUpdate
+			if err := json.Unmarshal(data, &u); err != nil {
+				t.Fatal(err)
+			}
+			updates = append(updates, u)
+		}
+	}
+	t.Fatalf("stream ended without a done event: %v", scanner.Err())
+	return nil, Job{}
+}
+
+func TestContentJob(t *testing.T) {
+	ts, _, _ := start(t, "")
+
+	var job Job
+	body := `{"files": [
+		{"path": "a.go", "content": ` + quote(source) + `, "lint_output": "a.go:4:2: declared and not used: x"},
+		{"path": "b.go", "content": ` + quote(source) + `, "lint_output": "b.go:1:1: something else"}
+	]}`
+	if code := call(t, ts, "POST", "/jobs", body, &job); code != http.StatusCreated {
+		t.Fatalf("POST /jobs = %d", code)
+	}
+	updates, done := events(t, ts, job.ID)
+
+	if len(updates) == 0 || updates[0].Status != "Attempt 1/1" {
+		t.Errorf("updates = %+v", updates)
+	}
+	if done.State != Done || len(done.Files) != 2 {
+		t.Fatalf("done = %+v", done)
+	}
+	a, b := done.Files[0], done.Files[1]
+	if a.Status != "Fixed" || !a.Changed || a.Result != fixed || a.Usage.Requests != 1 {
+		t.Errorf("a.go = %+v", a)
+	}
+	if b.Status != "Failed" || b.Changed {
+		t.Errorf("b.go = %+v", b)
+	}
+
+	resp, err := ts.Client().Get(ts.URL + "/jobs/" + job.ID + "/diff?path=a.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(patch), "--- a/a.go") || !strings.Contains(string(patch), "-\tx := 1") {
+		t.Errorf("diff =\n%s", patch)
+	}
+
+	var decisions []Decision
+	if code := call(t, ts, "POST", "/jobs/"+job.ID+"/accept", `{"paths": ["a.go"]}`, &decisions); code != http.StatusOK {
+		t.Errorf("accept = %d %+v", code, decisions)
+	}
+	if code := call(t, ts, "POST", "/jobs/"+job.ID+"/reject", `{"paths": ["a.go"]}`, &decisions); code != http.StatusConflict {
+		t.Errorf("rejecting an accepted file = %d %+v", code, decisions)
+	}
+}
+
+func TestDirJob(t *testing.T) {
+	ts, root, release := start(t, "")
+	a, b := filepath.Join(root, "pkg", "a.go"), filepath.Join(root, "pkg", "b.go")
+
+	var job Job
+	if code := call(t, ts, "POST", "/jobs", `{"dir": "pkg"}`, &job); code != http.StatusCreated {
+		t.Fatalf("POST /jobs = %d", code)
+	}
+	if job.State != Running || len(job.Files) != 2 {
+		t.Fatalf("job = %+v", job)
+	}
+	var errBody map[string]string
+	if code := call(t, ts, "POST", "/jobs", `{"dir": "."}`, &errBody); code != http.StatusConflict {
+		t.Errorf("overlapping job = %d %v", code, errBody)
+	}
+	if code := call(t, ts, "POST", "/jobs/"+job.ID+"/accept", "", &errBody); code != http.StatusConflict {
+		t.Errorf("accepting a running job = %d %v", code, errBody)
+	}
+
+	close(release)
+	_, done := events(t, ts, job.ID)
+	for _, f := range done.Files {
+		if f.Status != "Fixed" || !f.Changed || f.Result != "" {
+			t.Errorf("%s = %+v", f.Path, f)
+		}
+	}
+
+	// b.go is edited after the fix, so rejecting it must not lose the edit.
+	if err := os.WriteFile(b, []byte(fixed+"// edited\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var decisions []Decision
+	if code := call(t, ts, "POST", "/jobs/"+job.ID+"/reject", "", &decisions); code != http.StatusConflict {
+		t.Errorf("reject = %d %+v", code, decisions)
+	}
+	if len(decisions) != 2 || decisions[0].Decision != Rejected || decisions[1].Error == "" {
+		t.Errorf("decisions = %+v", decisions)
+	}
+	if got, _ := os.ReadFile(a); string(got) != source {
+		t.Errorf("a.go was not restored:\n%s", got)
+	}
+	if got, _ := os.ReadFile(b); string(got) != fixed+"// edited\n" {
+		t.Errorf("b.go lost its edit:\n%s", got)
+	}
+
+	// Replaying the stream from an event ID skips the earlier events.
+	req, _ := http.NewRequest("GET", ts.URL+"/jobs/"+job.ID+"/events", nil)
+	req.Header.Set("Last-Event-ID", "2")
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if strings.Contains(string(stream), "id: 2\n") || !strings.Contains(string(stream), "id: 3\n") {
+		t.Errorf("resumed stream =\n%s", stream)
+	}
+}
+
+func TestRejectWithoutOriginal(t *testing.T) {
+	ts, root := serve(t, "", failingRunner{})
+	a := filepath.Join(root, "pkg", "a.go")
+
+	var job Job
+	if code := call(t, ts, "POST", "/jobs", `{"dir": "pkg"}`, &job); code != http.StatusCreated {
+		t.Fatalf("POST /jobs = %d", code)
+	}
+	_, done := events(t, ts, job.ID)
+	for _, f := range done.Files {
+		if f.Status != "Failed" || f.Changed {
+			t.Errorf("%s = %+v", f.Path, f)
+		}
+	}
+	var decisions []Decision
+	if code := call(t, ts, "POST", "/jobs/"+job.ID+"/reject", "", &decisions); code != http.StatusOK {
+		t.Errorf("reject = %d %+v", code, decisions)
+	}
+	if got, _ := os.ReadFile(a); string(got) != source {
+		t.Errorf("a.go = %q, want it untouched", got)
+	}
+}
+
+func TestRejectsBadRequests(t *testing.T) {
+	ts, root, _ := start(t, "secret")
+
+	if code := call(t, ts, "GET", "/jobs", "", nil); code != http.StatusUnauthorized {
+		t.Errorf("no token = %d", code)
+	}
+	for host, want := range map[string]int{"evil.example:80": http.StatusForbidden, "localhost:8484": http.StatusUnauthorized, "refactor.internal": http.StatusUnauthorized} {
+		req, _ := http.NewRequest("GET", ts.URL+"/jobs", nil)
+		req.Host = host
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("Host %s = %d, want %d", host, resp.StatusCode, want)
+		}
+	}
+
+	authed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("Authorization", "Bearer secret")
+		ts.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer authed.Close()
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "a.go"), []byte(source), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{`{"dir": "../.."}`, `{"dir": "/etc"}`, `{"dir": "link"}`, `{"dir": "missing"}`, `{"bogus": 1}`, `{"files": [{"content": "x"}]}`} {
+		var errBody map[string]string
+		if code := call(t, authed, "POST", "/jobs", body, &errBody); code != http.StatusBadRequest || errBody["error"] == "" {
+			t.Errorf("POST %s = %d %v", body, code, errBody)
+		}
+	}
+	if code := call(t, authed, "GET", "/jobs/42", "", nil); code != http.StatusNotFound {
+		t.Errorf("unknown job = %d", code)
+	}
+}
+
+func quote(s string) string {
+	data, _ := json.Marshal(s)
+	return string(data)
+}
@@ -0,0 +1,167 @@
+package autofix
+
+import (
+	"bytes"
+	"context"
+	"deeprefactor/internal/ai"
+	"deeprefactor/internal/backup"
+	"deeprefactor/internal/driver"
+	"deeprefactor/internal/processor"
+	"deeprefactor/pkg/utils"
+	"errors"
+	"fmt"
+	"go/format"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/imports"
+)
+
+// Fixer applies a mechanical fix to a file. Fix returns the fixed version
+// of src, the current content of path, and leaves writing it to Run. Apply
+// is for external tools that can only fix the file in place.
+type Fixer struct {
+	Name  string
+	Fix   func(ctx context.Context, path string, src []byte) ([]byte, error)
+	Apply func(ctx context.Context, path string) error
+}
+
+var registry = map[string]Fixer{
+	"gofmt":         {Name: "gofmt", Fix: gofmt},
+	"goimports":     {Name: "goimports", Fix: goimports},
+	"golangci-lint": {Name: "golangci-lint", Apply: golangciFix},
+	"analysis":      {Name: "analysis", Fix: suggestedFixes},
+}
+
+// Register adds a fixer that can be selected by name.
+func Register(f Fixer) {
+	registry[f.Name] = f
+}
+
+// Names lists the registered fixers.
+func Names() []string {
+	var names []string
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Lookup resolves fixer names in order. "none" selects no fixers.
+func Lookup(names []string) ([]Fixer, error) {
+	var fixers []Fixer
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" || name == "none" {
+			continue
+		}
+		f, ok := registry[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown autofixer %q (available: %s)", name, strings.Join(Names(), ", "))
+		}
+		fixers = append(fixers, f)
+	}
+	return fixers, nil
+}
+
+// Run applies the fixers to path in order and returns the names of those
+// that changed the file. The original is saved to b right before the first
+// write. Fixes are merged with edits made to the file while they ran, and
+// ai.ErrConflict is returned when the two overlap.
+func Run(ctx context.Context, fixers []Fixer, path string, b *backup.Run) ([]string, error) {
+	var applied []string
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range fixers {
+		var out []byte
+		if f.Fix != nil {
+			if out, err = f.Fix(ctx, path, src); err != nil {
+				return applied, fmt.Errorf("%s: %w", f.Name, err)
+			}
+			// Formatters emit LF, which SafeWriteFile turns back into the
+			// line endings of the file.
+			if utils.SameContent(src, out) {
+				continue
+			}
+			if _, err := (ai.Edit{Path: path, Before: string(src), After: string(out)}).Write(b); err != nil {
+				return applied, fmt.Errorf("%s: %w", f.Name, err)
+			}
+			// The next fixer starts from the file as written, with its
+			// line endings and any merged edits.
+			if out, err = os.ReadFile(path); err != nil {
+				return applied, err
+			}
+		} else {
+			// The tool rewrites the file itself, so only edits made before
+			// it starts can be kept. It may write the file, so it is saved
+			// first; Finish drops the backup again if nothing changed.
+			if src, err = os.ReadFile(path); err != nil {
+				return applied, err
+			}
+			if err := b.Save(path); err != nil {
+				return applied, err
+			}
+			if err := f.Apply(ctx, path); err != nil {
+				return applied, fmt.Errorf("%s: %w", f.Name, err)
+			}
+			if out, err = os.ReadFile(path); err != nil {
+				return applied, err
+			}
+			if bytes.Equal(src, out) {
+				continue
+			}
+		}
+		applied = append(applied, f.Name)
+		src = out
+	}
+	return applied, nil
+}
+
+func gofmt(_ context.Context, _ string, src []byte) ([]byte, error) {
+	return format.Source(src)
+}
+
+func goimports(_ context.Context, path string, src []byte) ([]byte, error) {
+	return imports.Process(path, src, &imports.Options{
+		Comments:   true,
+		TabIndent:  true,
+		TabWidth:   8,
+		FormatOnly: false,
+	})
+}
+
+// suggestedFixes applies the fixes suggested by the go vet analyzers. The
+// analyzers read the package from disk, where path holds src.
+func suggestedFixes(ctx context.Context, path string, src []byte) ([]byte, error) {
+	analyzers, err := driver.Lookup(nil)
+	if err != nil {
+		return nil, err
+	}
+	diags, err := driver.Check(ctx, path, analyzers)
+	if err != nil {
+		return nil, err
+	}
+	out, _, err := driver.ApplyFixes(path, src, diags)
+	return out, err
+}
+
+// golangciFix runs the autofixes built into golangci-lint. Its exit status
+// only reflects the remaining issues, so it is ignored.
+func golangciFix(ctx context.Context, path string) error {
+	cmd, err := processor.BuildCommand("golangci-lint run --fix {{filepath}}", path, false)
+	if err != nil {
+		return err
+	}
+	if _, err := cmd.Run(ctx); err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return err
+		}
+		return ctx.Err()
+	}
+	return nil
+}
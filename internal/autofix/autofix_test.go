@@ -0,0 +1,68 @@
+package autofix
+
+import (
+	"context"
+	"deeprefactor/internal/backup"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func crlf(s string) string {
+	return strings.ReplaceAll(s, "\n", "\r\n")
+}
+
+func TestRunCRLF(t *testing.T) {
+	tests := []struct {
+		name, src, want string
+		applied         []string
+	}{
+		{"formatted", "package a\n\nimport \"fmt\"\n\nfunc F() { fmt.Println() }\n", "package a\n\nimport \"fmt\"\n\nfunc F() { fmt.Println() }\n", nil},
+		{"unformatted", "package a\n\nimport \"fmt\"\n\nfunc F() {  fmt.Println() }\n", "package a\n\nimport \"fmt\"\n\nfunc F() { fmt.Println() }\n", []string{"gofmt"}},
+	}
+	fixers, err := Lookup([]string{"gofmt", "goimports"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "a.go")
+			if err := os.WriteFile(path, []byte(crlf(tt.src)), 0644); err != nil {
+				t.Fatal(err)
+			}
+			old := time.Now().Add(-time.Hour).Truncate(time.Second)
+			if err := os.Chtimes(path, old, old); err != nil {
+				t.Fatal(err)
+			}
+			b, err := backup.NewRun(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			applied, err := Run(context.Background(), fixers, path, b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(applied, tt.applied) {
+				t.Errorf("applied = %q, want %q", applied, tt.applied)
+			}
+			if got, _ := os.ReadFile(path); string(got) != crlf(tt.want) {
+				t.Errorf("file = %q, want %q", got, crlf(tt.want))
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if written := !info.ModTime().Equal(old); written != (tt.applied != nil) {
+				t.Errorf("file written = %v", written)
+			}
+			if saved := b.Len() > 0; saved != (tt.applied != nil) {
+				t.Errorf("backup entries = %d", b.Len())
+			}
+		})
+	}
+}
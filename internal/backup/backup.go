@@ -0,0 +1,341 @@
+// Package backup keeps the original content of the files a run changes so
+// that the run can be undone.
+package backup
+
+import (
+	"crypto/sha256"
+	"deeprefactor/pkg/utils"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const manifestName = "manifest.json"
+
+// Dir returns the directory holding the runs of the tree at root.
+func Dir(root string) string {
+	return filepath.Join(root, ".deeprefactor", "backups")
+}
+
+// Entry describes one file changed by a run.
+type Entry struct {
+	// Path is relative to the root of the run, or absolute for files
+	// outside it.
+	Path string `json:"path"`
+	// Original is the SHA-256 of the content before the run, or empty when
+	// the run created the file.
+	Original string      `json:"original,omitempty"`
+	Mode     fs.FileMode `json:"mode,omitempty"`
+	// Result is the SHA-256 of the content when the run finished, or empty
+	// if the file did not exist then.
+	Result string `json:"result,omitempty"`
+}
+
+// Manifest lists the files of a run.
+type Manifest struct {
+	ID      string    `json:"id"`
+	Root    string    `json:"root"`
+	Started time.Time `json:"started"`
+	// Finished is false for runs that were interrupted, whose results are
+	// unknown.
+	Finished bool    `json:"finished"`
+	Files    []Entry `json:"files"`
+}
+
+// Run is the backup of one run. Originals are stored once per content
+// under objects/<sha256> next to the manifest. The methods of a nil Run do
+// nothing, so callers need not check whether backups are enabled.
+type Run struct {
+	dir string
+
+	mu       sync.Mutex
+	manifest Manifest
+	saved    map[string]bool
+}
+
+// NewRun starts a run for the tree at root. Its ID is the start time.
+func NewRun(root string) (*Run, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(Dir(root), 0755); err != nil {
+		return nil, fmt.Errorf("create backup directory: %w", err)
+	}
+	start := time.Now()
+	id := start.Format("20060102-150405")
+	for n := 2; ; n++ {
+		err := os.Mkdir(filepath.Join(Dir(root), id), 0755)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, fmt.Errorf("create backup directory: %w", err)
+		}
+		id = start.Format("20060102-150405") + "-" + strconv.Itoa(n)
+	}
+	return &Run{
+		dir:      filepath.Join(Dir(root), id),
+		manifest: Manifest{ID: id, Root: root, Started: start},
+		saved:    make(map[string]bool),
+	}, nil
+}
+
+// Load opens the run with the given ID in the tree at root, or the latest
+// run if id is empty.
+func Load(root, id string) (*Run, error) {
+	if id == "" {
+		runs, err := List(root)
+		if err != nil {
+			return nil, err
+		}
+		if len(runs) == 0 {
+			return nil, fmt.Errorf("no backups in %s", Dir(root))
+		}
+		id = runs[len(runs)-1].ID
+	}
+	dir := filepath.Join(Dir(root), id)
+	data, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if err != nil {
+		return nil, fmt.Errorf("run %s: %w", id, err)
+	}
+	r := &Run{dir: dir}
+	if err := json.Unmarshal(data, &r.manifest); err != nil {
+		return nil, fmt.Errorf("run %s: %w", id, err)
+	}
+	return r, nil
+}
+
+// List returns the manifests of the runs in the tree at root, oldest first.
+func List(root string) ([]Manifest, error) {
+	dirs, err := filepath.Glob(filepath.Join(Dir(root), "*", manifestName))
+	if err != nil {
+		return nil, err
+	}
+	var runs []Manifest
+	for _, path := range dirs {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var m Manifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		runs = append(runs, m)
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Started.Before(runs[j].Started) })
+	return runs, nil
+}
+
+// ID returns the ID of r.
+func (r *Run) ID() string {
+	return r.manifest.ID
+}
+
+// Manifest returns a copy of the manifest of r.
+func (r *Run) Manifest() Manifest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m := r.manifest
+	m.Files = append([]Entry(nil), m.Files...)
+	return m
+}
+
+// Save backs up path unless it was saved before. It must be called before
+// the first write to path; a missing file is recorded as created by the
+// run.
+func (r *Run) Save(path string) error {
+	if r == nil {
+		return nil
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.saved[abs] {
+		return nil
+	}
+
+	entry := Entry{Path: r.rel(abs)}
+	data, err := os.ReadFile(abs)
+	switch {
+	case err == nil:
+		info, err := os.Stat(abs)
+		if err != nil {
+			return err
+		}
+		entry.Original = hash(data)
+		entry.Mode = info.Mode().Perm()
+		object := r.object(entry.Original)
+		if _, err := os.Stat(object); err != nil {
+			if err := os.MkdirAll(filepath.Dir(object), 0755); err != nil {
+				return fmt.Errorf("back up %s: %w", path, err)
+			}
+			if err := utils.ReplaceFile(object, data, 0644); err != nil {
+				return fmt.Errorf("back up %s: %w", path, err)
+			}
+		}
+	case !errors.Is(err, fs.ErrNotExist):
+		return fmt.Errorf("back up %s: %w", path, err)
+	}
+
+	r.manifest.Files = append(r.manifest.Files, entry)
+	if err := r.writeManifest(); err != nil {
+		r.manifest.Files = r.manifest.Files[:len(r.manifest.Files)-1]
+		return err
+	}
+	r.saved[abs] = true
+	return nil
+}
+
+// Len returns the number of files saved.
+func (r *Run) Len() int {
+	if r == nil {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.manifest.Files)
+}
+
+// Finish records the content of every saved file so that undo can tell
+// whether it changed later. Files that end up as they started are dropped,
+// and a run that changed nothing leaves no directory behind.
+func (r *Run) Finish() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	changed := r.manifest.Files[:0]
+	for _, e := range r.manifest.Files {
+		e.Result = ""
+		if data, err := os.ReadFile(r.abs(e.Path)); err == nil {
+			e.Result = hash(data)
+		}
+		if e.Result != e.Original {
+			changed = append(changed, e)
+		}
+	}
+	r.manifest.Files = changed
+	r.pruneObjects()
+	if len(r.manifest.Files) == 0 {
+		os.Remove(filepath.Join(r.dir, manifestName))
+		os.Remove(filepath.Join(r.dir, "objects"))
+		os.Remove(r.dir)
+		os.Remove(filepath.Dir(r.dir))
+		os.Remove(filepath.Dir(filepath.Dir(r.dir)))
+		return nil
+	}
+	r.manifest.Finished = true
+	return r.writeManifest()
+}
+
+// pruneObjects removes the stored originals no entry refers to.
+func (r *Run) pruneObjects() {
+	used := make(map[string]bool)
+	for _, e := range r.manifest.Files {
+		used[e.Original] = true
+	}
+	entries, _ := os.ReadDir(filepath.Join(r.dir, "objects"))
+	for _, obj := range entries {
+		if !used[obj.Name()] {
+			os.Remove(r.object(obj.Name()))
+		}
+	}
+}
+
+// ErrChanged is returned by Restore for files that changed after the run.
+var ErrChanged = errors.New("changed since the run")
+
+// Restore puts back the original of e, or removes the file if the run
+// created it. Unless force is set, it refuses with ErrChanged when the file
+// no longer holds the content the run left, or when the run did not finish
+// and that content is unknown. It reports whether the file was removed.
+func (r *Run) Restore(e Entry, force bool) (removed bool, err error) {
+	path := r.abs(e.Path)
+	current := ""
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		current = hash(data)
+	case !errors.Is(err, fs.ErrNotExist):
+		return false, err
+	}
+	if !force {
+		if !r.manifest.Finished {
+			return false, fmt.Errorf("%w: the run did not finish, so changes to %s cannot be detected", ErrChanged, e.Path)
+		}
+		if current != e.Result {
+			return false, fmt.Errorf("%s %w", e.Path, ErrChanged)
+		}
+	}
+
+	if e.Original == "" {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return false, err
+		}
+		return true, nil
+	}
+	if current == e.Original {
+		return false, nil
+	}
+	original, err := os.ReadFile(r.object(e.Original))
+	if err != nil {
+		return false, fmt.Errorf("read backup of %s: %w", e.Path, err)
+	}
+	if hash(original) != e.Original {
+		return false, fmt.Errorf("backup of %s is corrupt", e.Path)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return false, err
+	}
+	return false, utils.ReplaceFile(path, original, e.Mode)
+}
+
+// Abs returns the absolute path of e.
+func (r *Run) Abs(e Entry) string {
+	return r.abs(e.Path)
+}
+
+func (r *Run) writeManifest() error {
+	data, err := json.MarshalIndent(r.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.ReplaceFile(filepath.Join(r.dir, manifestName), data, 0644)
+}
+
+func (r *Run) object(sum string) string {
+	return filepath.Join(r.dir, "objects", sum)
+}
+
+func (r *Run) rel(abs string) string {
+	if rel, err := filepath.Rel(r.manifest.Root, abs); err == nil && filepath.IsLocal(rel) {
+		return filepath.ToSlash(rel)
+	}
+	return abs
+}
+
+func (r *Run) abs(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(r.manifest.Root, filepath.FromSlash(path))
+}
+
+func hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
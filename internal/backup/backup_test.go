@@ -0,0 +1,67 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFinishDropsUnchangedFiles(t *testing.T) {
+	root := t.TempDir()
+	changed, untouched := filepath.Join(root, "changed.go"), filepath.Join(root, "untouched.go")
+	for _, path := range []string{changed, untouched} {
+		if err := os.WriteFile(path, []byte("package a // "+filepath.Base(path)+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run, err := NewRun(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{changed, untouched} {
+		if err := run.Save(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(changed, []byte("package a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := run.Finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := Load(root, run.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := loaded.Manifest().Files
+	if len(files) != 1 || files[0].Path != "changed.go" {
+		t.Fatalf("manifest lists %+v, want changed.go only", files)
+	}
+	objects, _ := os.ReadDir(filepath.Join(Dir(root), run.ID(), "objects"))
+	if len(objects) != 1 {
+		t.Errorf("%d objects kept, want 1", len(objects))
+	}
+}
+
+func TestFinishWithoutChangesLeavesNothing(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(root, "a.go")
+	if err := os.WriteFile(path, []byte("package a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	run, err := NewRun(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := run.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := run.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, ".deeprefactor")); !os.IsNotExist(err) {
+		t.Errorf("backup directory left behind: %v", err)
+	}
+}
@@ -0,0 +1,313 @@
+package checker
+
+import (
+	"context"
+	"deeprefactor/internal/driver"
+	"deeprefactor/internal/processor"
+	"deeprefactor/internal/types"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Parser names understood by Checker.
+const (
+	// ParseLines reads "file:line:col: message" diagnostics and fails on a
+	// non-zero exit status.
+	ParseLines = "lines"
+	// ParseFiles reads a list of offending files, as printed by gofmt -l,
+	// and fails when the list is not empty. For a package directory only
+	// its own files count, since gofmt -l also lists subdirectories.
+	ParseFiles = "files"
+	// ParseText fails on a non-zero exit status and passes the output to
+	// the model as is.
+	ParseText = "text"
+	// ParseAnalysis runs go/analysis analyzers in-process instead of a
+	// command. The command lists the analyzers or suites to run,
+	// separated by commas.
+	ParseAnalysis = "analysis"
+	// ParsePattern fails while the regular expression in the command
+	// matches the target file, reporting each matching line.
+	ParsePattern = "pattern"
+)
+
+type Checker struct {
+	Name     string
+	Cmd      string
+	Parser   string
+	Blocking bool
+	// Package runs the command in the directory of the target's package,
+	// for tools that need the whole package to type-check it. Only the
+	// diagnostics in the target file are kept.
+	Package bool
+}
+
+type Result struct {
+	Checker     Checker
+	Passed      bool
+	Output      string
+	Diagnostics []types.Diagnostic
+}
+
+var presets = map[string]Checker{
+	"gofmt":         {Name: "gofmt", Cmd: "gofmt -l {{filepath}}", Parser: ParseFiles, Blocking: true},
+	"vet":           {Name: "vet", Cmd: "go vet .", Parser: ParseLines, Blocking: true, Package: true},
+	"staticcheck":   {Name: "staticcheck", Cmd: "staticcheck .", Parser: ParseLines, Blocking: true, Package: true},
+	"golangci-lint": {Name: "golangci-lint", Cmd: "golangci-lint run {{filepath}}", Parser: ParseLines, Blocking: true},
+	"analysis":      {Name: "analysis", Cmd: "vet,custom", Parser: ParseAnalysis, Blocking: true},
+}
+
+// Parse reads a checker specification of the form
+//
+//	name[:parser][?][=command]
+//
+// where name alone selects a preset (gofmt, vet, staticcheck,
+// golangci-lint, analysis), a trailing "?" on the name makes the checker
+// advisory so it does not block success, and parser is one of lines, files,
+// text, analysis or pattern. For the analysis parser the command is a
+// comma-separated list of analyzers, such as "analysis=vet,nilness", and for
+// the pattern parser it is a regular expression that must not match.
+func Parse(spec string) (Checker, error) {
+	head, cmd, hasCmd := strings.Cut(spec, "=")
+	head = strings.TrimSpace(head)
+
+	blocking := !strings.HasSuffix(head, "?")
+	head = strings.TrimSuffix(head, "?")
+	name, parser, hasParser := strings.Cut(head, ":")
+	if name == "" {
+		return Checker{}, fmt.Errorf("checker %q has no name", spec)
+	}
+
+	c, ok := presets[name]
+	if !hasCmd && !ok {
+		return Checker{}, fmt.Errorf("unknown checker %q; use name=command for custom checkers", name)
+	}
+	if !ok {
+		c = Checker{Name: name, Parser: ParseLines}
+	}
+	if hasCmd {
+		c.Cmd = strings.TrimSpace(cmd)
+		c.Package = false
+	}
+	if hasParser {
+		switch parser {
+		case ParseLines, ParseFiles, ParseText, ParseAnalysis, ParsePattern:
+			c.Parser = parser
+		default:
+			return Checker{}, fmt.Errorf("checker %q: unknown parser %q", name, parser)
+		}
+	}
+	switch c.Parser {
+	case ParseAnalysis:
+		if _, err := driver.Lookup(strings.Split(c.Cmd, ",")); err != nil {
+			return Checker{}, fmt.Errorf("checker %q: %w", name, err)
+		}
+	case ParsePattern:
+		if _, err := regexp.Compile(c.Cmd); err != nil {
+			return Checker{}, fmt.Errorf("checker %q: %w", name, err)
+		}
+	}
+	c.Blocking = blocking
+	return c, nil
+}
+
+// Run checks target, which is a Go file or a package directory.
+func (c Checker) Run(ctx context.Context, target string, shell bool) Result {
+	switch c.Parser {
+	case ParseAnalysis:
+		return c.analyze(ctx, target)
+	case ParsePattern:
+		return c.grep(target)
+	}
+	cmd, err := processor.BuildCommand(c.Cmd, target, shell)
+	if err != nil {
+		return Result{Checker: c, Output: err.Error()}
+	}
+	if c.Package {
+		cmd.Dir = target
+		if info, err := os.Stat(target); err != nil || !info.IsDir() {
+			cmd.Dir = filepath.Dir(target)
+		}
+	}
+	output, err := cmd.Run(ctx)
+	res := Result{Checker: c, Output: output, Passed: err == nil}
+
+	switch c.Parser {
+	case ParseFiles:
+		info, statErr := os.Stat(target)
+		pkgDir := statErr == nil && info.IsDir()
+		var lines []string
+		for _, line := range strings.Split(output, "\n") {
+			if line = strings.TrimSpace(line); line == "" || pkgDir && !processor.SameFile(filepath.Dir(line), target) {
+				continue
+			}
+			res.Diagnostics = append(res.Diagnostics, types.Diagnostic{
+				File:    line,
+				Line:    1,
+				Column:  1,
+				Message: fmt.Sprintf("file is not %s clean", c.Name),
+				Linter:  c.Name,
+			})
+			lines = append(lines, line)
+		}
+		res.Passed = err == nil && len(lines) == 0
+		if err == nil {
+			res.Output = strings.Join(lines, "\n")
+		}
+	case ParseLines:
+		res.Diagnostics = processor.ParseDiagnostics(output)
+		for i := range res.Diagnostics {
+			if res.Diagnostics[i].Linter == "" {
+				res.Diagnostics[i].Linter = c.Name
+			}
+		}
+		if c.Package {
+			c.keepTarget(&res, cmd.Dir, target)
+		}
+	}
+	if !res.Passed && res.Output == "" && err != nil {
+		res.Output = err.Error()
+	}
+	return res
+}
+
+// keepTarget resolves the diagnostics of a package checker, which are
+// relative to dir, and keeps those in target unless it is the directory
+// itself. A run that failed without any diagnostics keeps failing.
+func (c Checker) keepTarget(res *Result, dir, target string) {
+	if res.Passed || len(res.Diagnostics) == 0 {
+		return
+	}
+	var kept []types.Diagnostic
+	var lines []string
+	for _, d := range res.Diagnostics {
+		if !filepath.IsAbs(d.File) {
+			d.File = filepath.Join(dir, d.File)
+		}
+		if processor.SameFile(dir, target) || processor.SameFile(d.File, target) {
+			kept = append(kept, d)
+			lines = append(lines, d.String())
+		}
+	}
+	res.Diagnostics = kept
+	res.Output = strings.Join(lines, "\n")
+	res.Passed = len(kept) == 0
+}
+
+// analyze runs the analyzers named by the command in-process.
+func (c Checker) analyze(ctx context.Context, target string) Result {
+	res := Result{Checker: c}
+	analyzers, err := driver.Lookup(strings.Split(c.Cmd, ","))
+	if err == nil {
+		res.Diagnostics, err = driver.Check(ctx, target, analyzers)
+	}
+	if err != nil {
+		res.Output = err.Error()
+		return res
+	}
+	lines := make([]string, len(res.Diagnostics))
+	hinted := make(map[string]bool)
+	var hints []string
+	for i, d := range res.Diagnostics {
+		lines[i] = d.String()
+		if hint := driver.Hint(d.Linter); hint != "" && !hinted[d.Linter] {
+			hinted[d.Linter] = true
+			hints = append(hints, fmt.Sprintf("- %s: %s", d.Linter, hint))
+		}
+	}
+	res.Output = strings.Join(lines, "\n")
+	if len(hints) > 0 {
+		res.Output += "\n\nHow to fix:\n" + strings.Join(hints, "\n")
+	}
+	res.Passed = len(res.Diagnostics) == 0
+	return res
+}
+
+// grep reports the lines of target, or of the Go files in the target
+// directory, that match the pattern in the command.
+func (c Checker) grep(target string) Result {
+	res := Result{Checker: c}
+	re, err := regexp.Compile(c.Cmd)
+	if err != nil {
+		res.Output = err.Error()
+		return res
+	}
+	paths := []string{target}
+	if info, err := os.Stat(target); err == nil && info.IsDir() {
+		paths, _ = filepath.Glob(filepath.Join(target, "*.go"))
+	}
+	var lines []string
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			res.Output = err.Error()
+			return res
+		}
+		for i, line := range strings.Split(string(content), "\n") {
+			loc := re.FindStringIndex(line)
+			if loc == nil {
+				continue
+			}
+			d := types.Diagnostic{
+				File:    path,
+				Line:    i + 1,
+				Column:  loc[0] + 1,
+				Message: fmt.Sprintf("still matches %q: %s", c.Cmd, strings.TrimSpace(line)),
+				Linter:  c.Name,
+			}
+			res.Diagnostics = append(res.Diagnostics, d)
+			lines = append(lines, d.String())
+		}
+	}
+	res.Output = strings.Join(lines, "\n")
+	res.Passed = len(res.Diagnostics) == 0
+	return res
+}
+
+// RunAll runs every checker in order against target.
+func RunAll(ctx context.Context, checkers []Checker, target string, shell bool) []Result {
+	results := make([]Result, len(checkers))
+	for i, c := range checkers {
+		results[i] = c.Run(ctx, target, shell)
+	}
+	return results
+}
+
+// Blocking returns the failed results of blocking checkers.
+func Blocking(results []Result) []Result {
+	var failed []Result
+	for _, r := range results {
+		if !r.Passed && r.Checker.Blocking {
+			failed = append(failed, r)
+		}
+	}
+	return failed
+}
+
+// Names lists the checker names of results.
+func Names(results []Result) string {
+	names := make([]string, len(results))
+	for i, r := range results {
+		names[i] = r.Checker.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+// Format groups the output of the failed checkers by checker, the way it
+// is shown in the log and sent to the model.
+func Format(results []Result) string {
+	var sb strings.Builder
+	for _, r := range results {
+		if r.Passed {
+			continue
+		}
+		label := r.Checker.Name
+		if !r.Checker.Blocking {
+			label += " (advisory)"
+		}
+		fmt.Fprintf(&sb, "[%s]\n%s\n\n", label, r.Output)
+	}
+	return strings.TrimSpace(sb.String())
+}
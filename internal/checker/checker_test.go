@@ -0,0 +1,66 @@
+package checker
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVetChecksThePackage(t *testing.T) {
+	dir := t.TempDir()
+	sources := map[string]string{
+		"go.mod": "module a\n\ngo 1.22\n",
+		"a.go":   "package a\n\nimport \"fmt\"\n\nfunc A() {\n\tfmt.Printf(\"%d\\n\", B())\n}\n",
+		"b.go":   "package a\n\nfunc B() string {\n\treturn \"b\"\n}\n",
+	}
+	for name, src := range sources {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vet, err := Parse("vet")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := vet.Run(context.Background(), filepath.Join(dir, "a.go"), false)
+	if a.Passed || len(a.Diagnostics) != 1 || a.Diagnostics[0].File != filepath.Join(dir, "a.go") || a.Diagnostics[0].Line != 6 {
+		t.Errorf("a.go = %+v", a)
+	}
+	if b := vet.Run(context.Background(), filepath.Join(dir, "b.go"), false); !b.Passed || len(b.Diagnostics) != 0 {
+		t.Errorf("b.go = %+v", b)
+	}
+	if pkg := vet.Run(context.Background(), dir, false); pkg.Passed || len(pkg.Diagnostics) != 1 {
+		t.Errorf("package = %+v", pkg)
+	}
+}
+
+func TestGofmtSkipsSubpackages(t *testing.T) {
+	dir := t.TempDir()
+	sources := map[string]string{
+		"a.go":     "package a\n",
+		"sub/b.go": "package sub\nfunc  B() {}\n",
+	}
+	for name, src := range sources {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gofmt, err := Parse("gofmt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pkg := gofmt.Run(context.Background(), dir, false); !pkg.Passed || len(pkg.Diagnostics) != 0 || pkg.Output != "" {
+		t.Errorf("package = %+v", pkg)
+	}
+	sub := gofmt.Run(context.Background(), filepath.Join(dir, "sub"), false)
+	if sub.Passed || len(sub.Diagnostics) != 1 || sub.Diagnostics[0].File != filepath.Join(dir, "sub", "b.go") {
+		t.Errorf("subpackage = %+v", sub)
+	}
+}
@@ -0,0 +1,150 @@
+// Package coverage finds functions that no test executes.
+package coverage
+
+import (
+	"context"
+	"deeprefactor/internal/processor"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/cover"
+)
+
+// Func is a function or method without coverage.
+type Func struct {
+	// Name is the function name, or Type.Method for methods.
+	Name string
+	Line int
+}
+
+// Uncovered runs the tests of every package under dir with a coverage
+// profile and returns the functions with zero coverage, keyed by source
+// file. Failing tests do not stop the run; files that are missing from the
+// profile count as entirely uncovered. Test files, main and init functions
+// are ignored, and so are the directories that "./..." leaves out, such as
+// testdata and vendor.
+func Uncovered(ctx context.Context, dir string) (map[string][]Func, error) {
+	root, module, err := processor.FindModule(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	profile, err := os.CreateTemp("", "deeprefactor-cover-*.out")
+	if err != nil {
+		return nil, err
+	}
+	profile.Close()
+	defer os.Remove(profile.Name())
+
+	cmd := exec.CommandContext(ctx, "go", "test", "-count=1", "-covermode=set", "-coverprofile="+profile.Name(), "./...")
+	cmd.Dir = dir
+	output, runErr := cmd.CombinedOutput()
+
+	profiles, err := cover.ParseProfiles(profile.Name())
+	if err != nil || (len(profiles) == 0 && runErr != nil) {
+		return nil, fmt.Errorf("go test -coverprofile failed: %v\n%s", runErr, strings.TrimSpace(string(output)))
+	}
+
+	blocks := make(map[string][]cover.ProfileBlock)
+	for _, p := range profiles {
+		rel := strings.TrimPrefix(strings.TrimPrefix(p.FileName, module), "/")
+		blocks[filepath.Join(root, filepath.FromSlash(rel))] = p.Blocks
+	}
+
+	files, err := processor.FindGoFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	uncovered := make(map[string][]Func)
+	for _, f := range files {
+		if strings.HasSuffix(f.Path, "_test.go") || skipped(dir, f.Path) {
+			continue
+		}
+		abs, err := filepath.Abs(f.Path)
+		if err != nil {
+			return nil, err
+		}
+		funcs, err := uncoveredFuncs(f.Path, blocks[abs])
+		if err != nil {
+			return nil, err
+		}
+		if len(funcs) > 0 {
+			uncovered[f.Path] = funcs
+		}
+	}
+	return uncovered, nil
+}
+
+// skipped reports whether path is in a directory under dir that the go
+// command ignores when matching "./...".
+func skipped(dir, path string) bool {
+	rel, err := filepath.Rel(dir, filepath.Dir(path))
+	if err != nil || rel == "." {
+		return false
+	}
+	for _, elem := range strings.Split(filepath.ToSlash(rel), "/") {
+		if elem == "testdata" || elem == "vendor" || strings.HasPrefix(elem, ".") || strings.HasPrefix(elem, "_") {
+			return true
+		}
+	}
+	return false
+}
+
+// uncoveredFuncs returns the functions of path that no executed block falls
+// into.
+func uncoveredFuncs(path string, blocks []cover.ProfileBlock) ([]Func, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, path, nil, parser.SkipObjectResolution)
+	if err != nil {
+		return nil, err
+	}
+
+	var funcs []Func
+	for _, decl := range file.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Body == nil || len(fn.Body.List) == 0 || (fn.Recv == nil && (fn.Name.Name == "main" || fn.Name.Name == "init")) {
+			continue
+		}
+		start := fset.Position(fn.Body.Lbrace).Line
+		end := fset.Position(fn.Body.Rbrace).Line
+		covered := false
+		for _, b := range blocks {
+			if b.Count > 0 && b.StartLine >= start && b.EndLine <= end {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			funcs = append(funcs, Func{Name: funcName(fn), Line: fset.Position(fn.Pos()).Line})
+		}
+	}
+	sort.Slice(funcs, func(i, j int) bool { return funcs[i].Line < funcs[j].Line })
+	return funcs, nil
+}
+
+func funcName(fn *ast.FuncDecl) string {
+	if fn.Recv == nil || len(fn.Recv.List) == 0 {
+		return fn.Name.Name
+	}
+	t := fn.Recv.List[0].Type
+	if star, ok := t.(*ast.StarExpr); ok {
+		t = star.X
+	}
+	switch x := t.(type) {
+	case *ast.IndexExpr:
+		t = x.X
+	case *ast.IndexListExpr:
+		t = x.X
+	}
+	if id, ok := t.(*ast.Ident); ok {
+		return id.Name + "." + fn.Name.Name
+	}
+	return fn.Name.Name
+}
@@ -0,0 +1,35 @@
+package coverage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUncoveredSkipsTestdataAndVendor(t *testing.T) {
+	dir := t.TempDir()
+	sources := map[string]string{
+		"go.mod":             "module m\n\ngo 1.22\n",
+		"a.go":               "package m\n\nfunc A() int { return 1 }\n",
+		"testdata/broken.go": "package broken\n\nfunc B() int { return 2 }\n",
+		"vendor/v/v.go":      "package v\n\nfunc V() int { return 3 }\n",
+	}
+	for name, src := range sources {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	uncovered, err := Uncovered(context.Background(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uncovered) != 1 || len(uncovered[filepath.Join(dir, "a.go")]) != 1 {
+		t.Errorf("Uncovered = %v, want only A in a.go", uncovered)
+	}
+}
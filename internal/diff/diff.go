@@ -0,0 +1,190 @@
+package diff
+
+import (
+	"fmt"
+	"strings"
+)
+
+type OpKind int
+
+const (
+	Equal OpKind = iota
+	Insert
+	Delete
+)
+
+// Op is a single line of an edit script. OldLine and NewLine are 1-based
+// line numbers, zero when the line does not exist on that side.
+type Op struct {
+	Kind    OpKind
+	Text    string
+	OldLine int
+	NewLine int
+}
+
+type Hunk struct {
+	Ops []Op
+}
+
+func SplitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// Lines computes a shortest edit script turning a into b using Myers'
+// algorithm.
+func Lines(a, b []string) []Op {
+	n, m := len(a), len(b)
+	maxD := n + m
+	offset := maxD + 1
+	v := make([]int, 2*maxD+3)
+	var trace [][]int
+
+	for d := 0; d <= maxD; d++ {
+		// Backtracking from round d only reads the diagonals -d-1..d+1,
+		// so memory grows with D² rather than (N+M)·D.
+		snapshot := make([]int, 2*d+3)
+		copy(snapshot, v[offset-d-1:offset+d+2])
+		trace = append(trace, snapshot)
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrack(trace, a, b)
+			}
+		}
+	}
+	return nil
+}
+
+// backtrack walks the trace back from the end. trace[d] holds the
+// diagonals -d-1..d+1 at the start of round d.
+func backtrack(trace [][]int, a, b []string) []Op {
+	x, y := len(a), len(b)
+	var ops []Op
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		offset := d + 1
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[offset+prevK]
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			ops = append(ops, Op{Kind: Equal, Text: a[x-1], OldLine: x, NewLine: y})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				ops = append(ops, Op{Kind: Insert, Text: b[y-1], NewLine: y})
+			} else {
+				ops = append(ops, Op{Kind: Delete, Text: a[x-1], OldLine: x})
+			}
+		}
+		x, y = prevX, prevY
+	}
+
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+// Hunks groups an edit script into hunks with the given number of context
+// lines around each change.
+func Hunks(ops []Op, context int) []Hunk {
+	var hunks []Hunk
+	var current *Hunk
+	lastChange := -1
+
+	for i, op := range ops {
+		if op.Kind == Equal {
+			continue
+		}
+		start := max(i-context, lastChange+1)
+		if current != nil && i-lastChange-1 > 2*context {
+			current.Ops = append(current.Ops, ops[lastChange+1:lastChange+1+context]...)
+			hunks = append(hunks, *current)
+			current = nil
+		}
+		if current == nil {
+			current = &Hunk{}
+			current.Ops = append(current.Ops, ops[start:i]...)
+		} else {
+			current.Ops = append(current.Ops, ops[lastChange+1:i]...)
+		}
+		current.Ops = append(current.Ops, op)
+		lastChange = i
+	}
+	if current != nil {
+		end := min(lastChange+1+context, len(ops))
+		current.Ops = append(current.Ops, ops[lastChange+1:end]...)
+		hunks = append(hunks, *current)
+	}
+	return hunks
+}
+
+// Header returns the "@@ -a,b +c,d @@" line for the hunk.
+func (h Hunk) Header() string {
+	var oldStart, newStart, oldCount, newCount int
+	for _, op := range h.Ops {
+		if op.Kind != Insert {
+			if oldStart == 0 {
+				oldStart = op.OldLine
+			}
+			oldCount++
+		}
+		if op.Kind != Delete {
+			if newStart == 0 {
+				newStart = op.NewLine
+			}
+			newCount++
+		}
+	}
+	return fmt.Sprintf("@@ -%d,%d +%d,%d @@", oldStart, oldCount, newStart, newCount)
+}
+
+// Unified renders a unified diff between two versions of a file.
+func Unified(oldName, newName, oldText, newText string) string {
+	hunks := Hunks(Lines(SplitLines(oldText), SplitLines(newText)), 3)
+	if len(hunks) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", oldName, newName)
+	for _, h := range hunks {
+		sb.WriteString(h.Header() + "\n")
+		for _, op := range h.Ops {
+			switch op.Kind {
+			case Equal:
+				sb.WriteString(" " + op.Text + "\n")
+			case Insert:
+				sb.WriteString("+" + op.Text + "\n")
+			case Delete:
+				sb.WriteString("-" + op.Text + "\n")
+			}
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,50 @@
+package diff
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// apply rebuilds both sides of an edit script.
+func apply(ops []Op) (a, b []string) {
+	for _, op := range ops {
+		if op.Kind != Insert {
+			a = append(a, op.Text)
+		}
+		if op.Kind != Delete {
+			b = append(b, op.Text)
+		}
+	}
+	return a, b
+}
+
+func TestLines(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := func(n int) []string {
+		lines := make([]string, n)
+		for i := range lines {
+			lines[i] = fmt.Sprint(rng.Intn(4))
+		}
+		return lines
+	}
+	for i := 0; i < 200; i++ {
+		a, b := random(rng.Intn(30)), random(rng.Intn(30))
+		gotA, gotB := apply(Lines(a, b))
+		if fmt.Sprint(gotA) != fmt.Sprint(a) || fmt.Sprint(gotB) != fmt.Sprint(b) {
+			t.Fatalf("Lines(%q, %q) rebuilds %q, %q", a, b, gotA, gotB)
+		}
+	}
+}
+
+func TestLinesRewrite(t *testing.T) {
+	// Every line differs, the worst case for the trace.
+	a, b := make([]string, 3000), make([]string, 3000)
+	for i := range a {
+		a[i], b[i] = fmt.Sprint("old ", i), fmt.Sprint("new ", i)
+	}
+	ops := Lines(a, b)
+	if len(ops) != 6000 {
+		t.Errorf("got %d ops, want 6000", len(ops))
+	}
+}
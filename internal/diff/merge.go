@@ -0,0 +1,82 @@
+package diff
+
+import "strings"
+
+// region replaces the base lines [start, end) with lines.
+type region struct {
+	start, end int
+	lines      []string
+}
+
+// regions groups the changes of an edit script by the base lines they
+// replace.
+func regions(ops []Op) []region {
+	var out []region
+	var cur *region
+	i := 0
+	for _, op := range ops {
+		if op.Kind == Equal {
+			if cur != nil {
+				out = append(out, *cur)
+				cur = nil
+			}
+			i++
+			continue
+		}
+		if cur == nil {
+			cur = &region{start: i, end: i}
+		}
+		if op.Kind == Delete {
+			i++
+			cur.end = i
+		} else {
+			cur.lines = append(cur.lines, op.Text)
+		}
+	}
+	if cur != nil {
+		out = append(out, *cur)
+	}
+	return out
+}
+
+func (r region) same(o region) bool {
+	return r.start == o.start && r.end == o.end && strings.Join(r.lines, "\n") == strings.Join(o.lines, "\n")
+}
+
+// Merge3 applies the line changes from base to ours and from base to
+// theirs together. It reports false when both sides change the same or
+// adjacent lines differently, leaving the caller to resolve the conflict.
+// Line endings are normalized to LF.
+func Merge3(base, ours, theirs string) (string, bool) {
+	baseLines := SplitLines(base)
+	a := regions(Lines(baseLines, SplitLines(ours)))
+	b := regions(Lines(baseLines, SplitLines(theirs)))
+
+	var out []string
+	pos := 0
+	apply := func(r region) {
+		out = append(out, baseLines[pos:r.start]...)
+		out = append(out, r.lines...)
+		pos = r.end
+	}
+	for len(a) > 0 || len(b) > 0 {
+		switch {
+		case len(b) == 0 || (len(a) > 0 && a[0].end < b[0].start):
+			apply(a[0])
+			a = a[1:]
+		case len(a) == 0 || b[0].end < a[0].start:
+			apply(b[0])
+			b = b[1:]
+		case a[0].same(b[0]):
+			apply(a[0])
+			a, b = a[1:], b[1:]
+		default:
+			return "", false
+		}
+	}
+	out = append(out, baseLines[pos:]...)
+	if len(out) == 0 {
+		return "", true
+	}
+	return strings.Join(out, "\n") + "\n", true
+}
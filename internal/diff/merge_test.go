@@ -0,0 +1,28 @@
+package diff
+
+import "testing"
+
+func TestMerge3(t *testing.T) {
+	const base = "a\nb\nc\nd\ne\n"
+	tests := []struct {
+		name, ours, theirs, want string
+		ok                       bool
+	}{
+		{"only ours", "a\nB\nc\nd\ne\n", base, "a\nB\nc\nd\ne\n", true},
+		{"only theirs", base, "a\nb\nc\nd\nE\n", "a\nb\nc\nd\nE\n", true},
+		{"separate lines", "A\nb\nc\nd\ne\n", "a\nb\nc\nd\nE\n", "A\nb\nc\nd\nE\n", true},
+		{"insert and delete", "a\nb\nx\nc\nd\ne\n", "a\nb\nc\ne\n", "a\nb\nx\nc\ne\n", true},
+		{"same change", "a\nB\nc\nd\ne\n", "a\nB\nc\nd\ne\n", "a\nB\nc\nd\ne\n", true},
+		{"same line", "a\nB\nc\nd\ne\n", "a\nX\nc\nd\ne\n", "", false},
+		{"adjacent lines", "a\nB\nc\nd\ne\n", "a\nb\nC\nd\ne\n", "", false},
+		{"crlf", "a\r\nB\r\nc\r\nd\r\ne\r\n", "a\nb\nc\nd\nE\n", "a\nB\nc\nd\nE\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := Merge3(base, tt.ours, tt.theirs)
+			if ok != tt.ok || got != tt.want {
+				t.Errorf("Merge3 = %q, %v, want %q, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
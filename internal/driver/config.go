@@ -0,0 +1,97 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"plugin"
+
+	"golang.org/x/tools/go/analysis"
+)
+
+// Config selects the analyzers of the "custom" suite. Plugins are Go
+// plugins, built with -buildmode=plugin against the same golang.org/x/tools
+// version, that export
+//
+//	var Analyzers []*analysis.Analyzer
+//
+// and optionally
+//
+//	var Hints map[string]string
+type Config struct {
+	Plugins   []string         `json:"plugins"`
+	Analyzers []AnalyzerConfig `json:"analyzers"`
+}
+
+// AnalyzerConfig names an analyzer to include and the hint given to the
+// model for its findings. Hints may also be set for built-in analyzers.
+type AnalyzerConfig struct {
+	Name string `json:"name"`
+	Hint string `json:"hint"`
+}
+
+// LoadConfig reads a JSON analyzer configuration, opens its plugins and
+// restricts the "custom" suite to the listed analyzers. Plugin paths are
+// relative to the configuration file.
+func LoadConfig(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read analyzer config: %w", err)
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("parse analyzer config %s: %w", path, err)
+	}
+
+	for _, p := range cfg.Plugins {
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(filepath.Dir(path), p)
+		}
+		if err := loadPlugin(p); err != nil {
+			return err
+		}
+	}
+
+	if len(cfg.Analyzers) == 0 {
+		return nil
+	}
+	var custom []string
+	for _, a := range cfg.Analyzers {
+		if _, ok := registry[a.Name]; !ok {
+			return fmt.Errorf("analyzer config %s: unknown analyzer %q", path, a.Name)
+		}
+		if a.Hint != "" {
+			hints[a.Name] = a.Hint
+		}
+		custom = append(custom, a.Name)
+	}
+	suites["custom"] = custom
+	return nil
+}
+
+func loadPlugin(path string) error {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return fmt.Errorf("open analyzer plugin: %w", err)
+	}
+	sym, err := p.Lookup("Analyzers")
+	if err != nil {
+		return fmt.Errorf("analyzer plugin %s: %w", path, err)
+	}
+	analyzers, ok := sym.(*[]*analysis.Analyzer)
+	if !ok {
+		return fmt.Errorf("analyzer plugin %s: Analyzers has type %T, want []*analysis.Analyzer", path, sym)
+	}
+
+	var pluginHints map[string]string
+	if sym, err := p.Lookup("Hints"); err == nil {
+		if h, ok := sym.(*map[string]string); ok {
+			pluginHints = *h
+		}
+	}
+	for _, a := range *analyzers {
+		Register(a, pluginHints[a.Name])
+	}
+	return nil
+}
@@ -0,0 +1,429 @@
+// Package driver runs go/analysis analyzers in-process, so checks need no
+// external linter and report exact positions and suggested fixes.
+package driver
+
+import (
+	"context"
+	"crypto/sha256"
+	"deeprefactor/internal/processor"
+	"deeprefactor/internal/types"
+	"fmt"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/tools/go/analysis"
+	"golang.org/x/tools/go/analysis/checker"
+	"golang.org/x/tools/go/analysis/passes/appends"
+	"golang.org/x/tools/go/analysis/passes/assign"
+	"golang.org/x/tools/go/analysis/passes/atomic"
+	"golang.org/x/tools/go/analysis/passes/bools"
+	"golang.org/x/tools/go/analysis/passes/buildtag"
+	"golang.org/x/tools/go/analysis/passes/composite"
+	"golang.org/x/tools/go/analysis/passes/copylock"
+	"golang.org/x/tools/go/analysis/passes/deepequalerrors"
+	"golang.org/x/tools/go/analysis/passes/defers"
+	"golang.org/x/tools/go/analysis/passes/directive"
+	"golang.org/x/tools/go/analysis/passes/errorsas"
+	"golang.org/x/tools/go/analysis/passes/httpresponse"
+	"golang.org/x/tools/go/analysis/passes/ifaceassert"
+	"golang.org/x/tools/go/analysis/passes/loopclosure"
+	"golang.org/x/tools/go/analysis/passes/lostcancel"
+	"golang.org/x/tools/go/analysis/passes/nilfunc"
+	"golang.org/x/tools/go/analysis/passes/nilness"
+	"golang.org/x/tools/go/analysis/passes/printf"
+	"golang.org/x/tools/go/analysis/passes/reflectvaluecompare"
+	"golang.org/x/tools/go/analysis/passes/shadow"
+	"golang.org/x/tools/go/analysis/passes/shift"
+	"golang.org/x/tools/go/analysis/passes/sigchanyzer"
+	"golang.org/x/tools/go/analysis/passes/slog"
+	"golang.org/x/tools/go/analysis/passes/sortslice"
+	"golang.org/x/tools/go/analysis/passes/stdmethods"
+	"golang.org/x/tools/go/analysis/passes/stringintconv"
+	"golang.org/x/tools/go/analysis/passes/structtag"
+	"golang.org/x/tools/go/analysis/passes/testinggoroutine"
+	"golang.org/x/tools/go/analysis/passes/tests"
+	"golang.org/x/tools/go/analysis/passes/timeformat"
+	"golang.org/x/tools/go/analysis/passes/unmarshal"
+	"golang.org/x/tools/go/analysis/passes/unreachable"
+	"golang.org/x/tools/go/analysis/passes/unsafeptr"
+	"golang.org/x/tools/go/analysis/passes/unusedresult"
+	"golang.org/x/tools/go/analysis/passes/unusedwrite"
+	"golang.org/x/tools/go/packages"
+	"honnef.co/go/tools/staticcheck"
+)
+
+var (
+	registry = map[string]*analysis.Analyzer{}
+	// hints explain to the model how to resolve an analyzer's findings.
+	hints = map[string]string{}
+)
+
+// suites are named groups of analyzers. "vet" mirrors the default go vet
+// suite, "extra" adds the stricter passes that go vet leaves out,
+// "staticcheck" holds the SA checks that staticcheck enables by default and
+// "custom" holds the analyzers registered by a custom build or plugin.
+var suites = map[string][]string{
+	"vet": {
+		"appends", "assign", "atomic", "bools", "buildtag", "composites",
+		"copylocks", "defers", "directive", "errorsas", "httpresponse",
+		"ifaceassert", "loopclosure", "lostcancel", "nilfunc", "printf",
+		"shift", "sigchanyzer", "slog", "stdmethods", "stringintconv",
+		"structtag", "testinggoroutine", "tests", "timeformat", "unmarshal",
+		"unreachable", "unsafeptr", "unusedresult",
+	},
+	"extra": {
+		"deepequalerrors", "nilness", "reflectvaluecompare", "shadow",
+		"sortslice", "unusedwrite",
+	},
+	"staticcheck": nil,
+	"custom":      nil,
+}
+
+func init() {
+	for _, a := range []*analysis.Analyzer{
+		appends.Analyzer, assign.Analyzer, atomic.Analyzer, bools.Analyzer,
+		buildtag.Analyzer, composite.Analyzer, copylock.Analyzer,
+		deepequalerrors.Analyzer, defers.Analyzer, directive.Analyzer,
+		errorsas.Analyzer, httpresponse.Analyzer, ifaceassert.Analyzer,
+		loopclosure.Analyzer, lostcancel.Analyzer, nilfunc.Analyzer,
+		nilness.Analyzer, printf.Analyzer, reflectvaluecompare.Analyzer,
+		shadow.Analyzer, shift.Analyzer, sigchanyzer.Analyzer, slog.Analyzer,
+		sortslice.Analyzer, stdmethods.Analyzer, stringintconv.Analyzer,
+		structtag.Analyzer, testinggoroutine.Analyzer, tests.Analyzer,
+		timeformat.Analyzer, unmarshal.Analyzer, unreachable.Analyzer,
+		unsafeptr.Analyzer, unusedresult.Analyzer, unusedwrite.Analyzer,
+	} {
+		registry[a.Name] = a
+	}
+	for _, a := range staticcheck.Analyzers {
+		registry[a.Analyzer.Name] = a.Analyzer
+		if !a.Doc.NonDefault {
+			suites["staticcheck"] = append(suites["staticcheck"], a.Analyzer.Name)
+		}
+	}
+}
+
+// Register adds an analyzer to the "custom" suite, with an optional hint
+// for the model. Registering a name twice replaces the earlier analyzer.
+func Register(a *analysis.Analyzer, hint string) {
+	if _, ok := registry[a.Name]; !ok {
+		suites["custom"] = append(suites["custom"], a.Name)
+	}
+	registry[a.Name] = a
+	if hint != "" {
+		hints[a.Name] = hint
+	}
+}
+
+// Hint returns the prompt hint of the named analyzer, if any.
+func Hint(name string) string {
+	return hints[name]
+}
+
+// Names lists the known analyzers and suites.
+func Names() []string {
+	var names []string
+	for name := range registry {
+		names = append(names, name)
+	}
+	for name := range suites {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Lookup resolves analyzer and suite names, dropping duplicates. No names
+// selects the vet suite.
+func Lookup(names []string) ([]*analysis.Analyzer, error) {
+	if len(names) == 0 {
+		names = []string{"vet"}
+	}
+	var analyzers []*analysis.Analyzer
+	seen := make(map[string]bool)
+	var add func(name string) error
+	add = func(name string) error {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			return nil
+		}
+		seen[name] = true
+		if members, ok := suites[name]; ok {
+			for _, m := range members {
+				if err := add(m); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		a, ok := registry[name]
+		if !ok {
+			return fmt.Errorf("unknown analyzer %q (available: %s)", name, strings.Join(Names(), ", "))
+		}
+		analyzers = append(analyzers, a)
+		return nil
+	}
+	for _, name := range names {
+		if err := add(name); err != nil {
+			return nil, err
+		}
+	}
+	return analyzers, nil
+}
+
+// maxResults bounds the cache of Check, which long-running commands such
+// as watch, lsp and serve would otherwise grow with every package checked.
+const maxResults = 64
+
+// results caches the diagnostics of each package per set of analyzers, so
+// that its files share one load and analysis until one of them changes.
+// The least recently used result is dropped when the cache is full.
+var results = struct {
+	sync.Mutex
+	m     map[string]*result
+	clock uint64
+}{m: make(map[string]*result)}
+
+type result struct {
+	// used is the clock of the last lookup, guarded by the results mutex.
+	used uint64
+
+	mu sync.Mutex
+	// dirs holds the package directory and those of the packages it
+	// imports from the main module; sum hashes their Go files.
+	dirs  []string
+	sum   [sha256.Size]byte
+	valid bool
+	diags []types.Diagnostic
+}
+
+// Check runs the analyzers on the package containing target and returns the
+// diagnostics reported in target. When target is a directory, the
+// diagnostics of every file in the package are returned. Type errors are
+// reported as diagnostics from the "typecheck" linter, since most analyzers
+// cannot run without type information.
+//
+// The package and its tests are loaded and analyzed once for all of its
+// files; later calls reuse the result while the Go files of the package and
+// of the packages it imports from the main module are unchanged.
+func Check(ctx context.Context, target string, analyzers []*analysis.Analyzer) ([]types.Diagnostic, error) {
+	abs, err := filepath.Abs(target)
+	if err != nil {
+		return nil, err
+	}
+	dir, file := abs, ""
+	if info, err := os.Stat(abs); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		dir, file = filepath.Dir(abs), abs
+	}
+
+	key := dir
+	for _, a := range analyzers {
+		key += "\x00" + a.Name
+	}
+	results.Lock()
+	r, ok := results.m[key]
+	if !ok {
+		r = &result{}
+		results.m[key] = r
+		for len(results.m) > maxResults {
+			evict(key)
+		}
+	}
+	results.clock++
+	r.used = results.clock
+	results.Unlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.valid {
+		sum, err := filesSum(r.dirs)
+		if err != nil {
+			return nil, err
+		}
+		r.valid = sum == r.sum
+	}
+	if !r.valid {
+		before, err := filesSum([]string{dir})
+		if err != nil {
+			return nil, err
+		}
+		diags, deps, err := analyze(ctx, dir, analyzers)
+		if err != nil {
+			return nil, err
+		}
+		r.diags, r.dirs = diags, append([]string{dir}, deps...)
+		if r.sum, err = filesSum(r.dirs); err != nil {
+			return nil, err
+		}
+		// A package edited during the analysis is analyzed again next time.
+		after, err := filesSum([]string{dir})
+		r.valid = err == nil && after == before
+	}
+
+	if file == "" {
+		return append([]types.Diagnostic(nil), r.diags...), nil
+	}
+	var diags []types.Diagnostic
+	for _, d := range r.diags {
+		if processor.SameFile(d.File, file) {
+			diags = append(diags, d)
+		}
+	}
+	return diags, nil
+}
+
+// evict drops the least recently used result other than keep. The caller
+// must hold the results mutex.
+func evict(keep string) {
+	oldest := ""
+	for key, r := range results.m {
+		if key != keep && (oldest == "" || r.used < results.m[oldest].used) {
+			oldest = key
+		}
+	}
+	delete(results.m, oldest)
+}
+
+// filesSum hashes the names and contents of the Go files in dirs.
+func filesSum(dirs []string) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	h := sha256.New()
+	for _, dir := range dirs {
+		paths, err := filepath.Glob(filepath.Join(dir, "*.go"))
+		if err != nil {
+			return sum, err
+		}
+		for _, path := range paths {
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return sum, err
+			}
+			fmt.Fprintf(h, "%s %d\n", path, len(content))
+			h.Write(content)
+		}
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+// analyze loads the package in dir with its tests and runs the analyzers
+// on it. It returns the diagnostics of all its files sorted by position and
+// the directories of the packages it imports from the main module.
+func analyze(ctx context.Context, dir string, analyzers []*analysis.Analyzer) ([]types.Diagnostic, []string, error) {
+	fset := token.NewFileSet()
+	pkgs, err := packages.Load(&packages.Config{
+		Context: ctx,
+		Mode:    packages.LoadAllSyntax | packages.NeedModule,
+		Dir:     dir,
+		Fset:    fset,
+		Tests:   true,
+	}, ".")
+	if err != nil {
+		return nil, nil, fmt.Errorf("load %s: %w", dir, err)
+	}
+	if len(pkgs) == 0 {
+		return nil, nil, fmt.Errorf("no package found in %s", dir)
+	}
+
+	var deps []string
+	seenDirs := map[string]bool{dir: true}
+	packages.Visit(pkgs, nil, func(p *packages.Package) {
+		if p.Module == nil || !p.Module.Main || len(p.GoFiles) == 0 {
+			return
+		}
+		if d := filepath.Dir(p.GoFiles[0]); !seenDirs[d] {
+			seenDirs[d] = true
+			deps = append(deps, d)
+		}
+	})
+
+	var diags []types.Diagnostic
+	seen := make(map[string]bool)
+	add := func(d types.Diagnostic) {
+		if key := d.String(); !seen[key] {
+			seen[key] = true
+			diags = append(diags, d)
+		}
+	}
+
+	broken := false
+	for _, pkg := range pkgs {
+		for _, e := range pkg.Errors {
+			broken = true
+			add(packageError(e))
+		}
+	}
+
+	graph, err := checker.Analyze(analyzers, pkgs, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, act := range graph.Roots {
+		if act.Err != nil {
+			if broken {
+				continue
+			}
+			return nil, nil, fmt.Errorf("%s: %w", act.Analyzer.Name, act.Err)
+		}
+		for _, d := range act.Diagnostics {
+			add(convert(fset, act.Analyzer.Name, d))
+		}
+	}
+
+	sort.SliceStable(diags, func(i, j int) bool {
+		a, b := diags[i], diags[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+	return diags, deps, nil
+}
+
+func convert(fset *token.FileSet, name string, d analysis.Diagnostic) types.Diagnostic {
+	pos := fset.Position(d.Pos)
+	diag := types.Diagnostic{
+		File:    pos.Filename,
+		Line:    pos.Line,
+		Column:  pos.Column,
+		Message: d.Message,
+		Linter:  name,
+	}
+	for _, sf := range d.SuggestedFixes {
+		fix := types.SuggestedFix{Message: sf.Message}
+		for _, e := range sf.TextEdits {
+			start := fset.Position(e.Pos)
+			end := start
+			if e.End.IsValid() {
+				end = fset.Position(e.End)
+			}
+			fix.Edits = append(fix.Edits, types.TextEdit{
+				File:    start.Filename,
+				Start:   start.Offset,
+				End:     end.Offset,
+				NewText: string(e.NewText),
+			})
+		}
+		diag.Fixes = append(diag.Fixes, fix)
+	}
+	return diag
+}
+
+// packageError turns a load or type error, positioned as "file:line:col",
+// into a diagnostic.
+func packageError(e packages.Error) types.Diagnostic {
+	d := types.Diagnostic{Message: e.Msg, Linter: "typecheck"}
+	if parsed := processor.ParseDiagnostics(e.Pos + ": " + e.Msg); len(parsed) == 1 {
+		d.File, d.Line, d.Column = parsed[0].File, parsed[0].Line, parsed[0].Column
+	}
+	return d
+}
@@ -0,0 +1,98 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func write(t *testing.T, path, src string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckReusesPackageAnalysis(t *testing.T) {
+	dir := t.TempDir()
+	write(t, filepath.Join(dir, "go.mod"), "module m\n\ngo 1.22\n")
+	write(t, filepath.Join(dir, "b", "b.go"), "package b\n\nfunc Name() string { return \"b\" }\n")
+	write(t, filepath.Join(dir, "a", "a.go"), "package a\n\nimport (\n\t\"fmt\"\n\t\"m/b\"\n)\n\nfunc A() { fmt.Printf(\"%d\\n\", b.Name()) }\n")
+	write(t, filepath.Join(dir, "a", "c.go"), "package a\n\nfunc C() {}\n")
+	analyzers, err := Lookup(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(path string) int {
+		t.Helper()
+		diags, err := Check(context.Background(), path, analyzers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(diags)
+	}
+
+	a, c := filepath.Join(dir, "a", "a.go"), filepath.Join(dir, "a", "c.go")
+	if n := check(a); n != 1 {
+		t.Errorf("a.go has %d diagnostics, want 1", n)
+	}
+	if n := check(c); n != 0 {
+		t.Errorf("c.go has %d diagnostics, want 0", n)
+	}
+
+	// Editing a sibling or an imported package invalidates the result.
+	write(t, c, "package a\n\nfunc C() { A(1) }\n")
+	if n := check(c); n != 1 {
+		t.Errorf("edited c.go has %d diagnostics, want 1", n)
+	}
+	write(t, filepath.Join(dir, "b", "b.go"), "package b\n\nfunc Name() int { return 1 }\n")
+	if n := check(a); n != 0 {
+		t.Errorf("a.go has %d diagnostics after b changed, want 0", n)
+	}
+}
+
+func TestStaticcheckSuite(t *testing.T) {
+	dir := t.TempDir()
+	write(t, filepath.Join(dir, "go.mod"), "module m\n\ngo 1.22\n")
+	write(t, filepath.Join(dir, "a.go"), "package a\n\nimport \"strings\"\n\nfunc A(s string) string {\n\tstrings.ToUpper(s)\n\treturn s\n}\n")
+	analyzers, err := Lookup([]string{"staticcheck"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	diags, err := Check(context.Background(), filepath.Join(dir, "a.go"), analyzers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diags) != 1 || diags[0].Linter != "SA4017" || diags[0].Line != 6 {
+		t.Errorf("diagnostics = %+v", diags)
+	}
+}
+
+func TestCheckCacheIsBounded(t *testing.T) {
+	dir := t.TempDir()
+	write(t, filepath.Join(dir, "go.mod"), "module m\n\ngo 1.22\n")
+	write(t, filepath.Join(dir, "a.go"), "package a\n")
+	analyzers, err := Lookup([]string{"bools"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results.Lock()
+	for i := 0; i < maxResults; i++ {
+		results.m[fmt.Sprint("old", i)] = &result{}
+	}
+	results.Unlock()
+
+	if _, err := Check(context.Background(), dir, analyzers); err != nil {
+		t.Fatal(err)
+	}
+	results.Lock()
+	defer results.Unlock()
+	if n := len(results.m); n != maxResults {
+		t.Errorf("cache holds %d results, want %d", n, maxResults)
+	}
+}
@@ -0,0 +1,56 @@
+package driver
+
+import (
+	"deeprefactor/internal/processor"
+	"deeprefactor/internal/types"
+	"fmt"
+	"sort"
+)
+
+// ApplyFixes applies the first suggested fix of each diagnostic to src, the
+// content of path, and returns how many fixes were applied. Fixes that
+// touch other files or overlap an earlier fix are skipped.
+func ApplyFixes(path string, src []byte, diags []types.Diagnostic) ([]byte, int, error) {
+	var edits []types.TextEdit
+	applied := 0
+	for _, d := range diags {
+		if len(d.Fixes) == 0 || !usable(path, src, d.Fixes[0], edits) {
+			continue
+		}
+		edits = append(edits, d.Fixes[0].Edits...)
+		applied++
+	}
+	if applied == 0 {
+		return src, 0, nil
+	}
+
+	sort.SliceStable(edits, func(i, j int) bool { return edits[i].Start < edits[j].Start })
+	out := make([]byte, 0, len(src))
+	last := 0
+	for _, e := range edits {
+		if e.Start < last {
+			return nil, 0, fmt.Errorf("overlapping edits at offset %d", e.Start)
+		}
+		out = append(out, src[last:e.Start]...)
+		out = append(out, e.NewText...)
+		last = e.End
+	}
+	out = append(out, src[last:]...)
+	return out, applied, nil
+}
+
+// usable reports whether every edit of fix stays inside path and does not
+// overlap the edits already accepted.
+func usable(path string, src []byte, fix types.SuggestedFix, accepted []types.TextEdit) bool {
+	for _, e := range fix.Edits {
+		if !processor.SameFile(e.File, path) || e.Start < 0 || e.End < e.Start || e.End > len(src) {
+			return false
+		}
+		for _, a := range accepted {
+			if e.Start < a.End && a.Start < e.End || e.Start == a.Start {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,147 @@
+// Package knowledge maps linters and rules to short fixing guidelines and
+// examples that are added to the prompt when those rules fire.
+package knowledge
+
+import (
+	"deeprefactor/internal/types"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+//go:embed rules.json
+var builtin []byte
+
+// ruleRe matches the rule ID that golangci-lint, revive and gocritic put in
+// front of their messages, as in "var-naming: ..." or "SA1019: ...".
+var ruleRe = regexp.MustCompile(`^([A-Za-z][\w-]*): `)
+
+// Entry is a fixing guideline for a linter, or for one rule of it when Rule
+// is set. Before and After optionally show a minimal fix.
+type Entry struct {
+	Linter    string `json:"linter"`
+	Rule      string `json:"rule,omitempty"`
+	Guideline string `json:"guideline"`
+	Before    string `json:"before,omitempty"`
+	After     string `json:"after,omitempty"`
+}
+
+func (e Entry) key() string {
+	return e.Linter + "/" + e.Rule
+}
+
+// Base is a set of entries keyed by linter and rule.
+type Base struct {
+	entries map[string]Entry
+	// byRule maps a rule to the key of the last entry added for it.
+	byRule map[string]string
+}
+
+// Default returns the built-in knowledge base.
+func Default() *Base {
+	b := &Base{entries: make(map[string]Entry), byRule: make(map[string]string)}
+	if err := b.add(builtin, "built-in rules"); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// Load adds the entries of a JSON file, or of every .json file in a
+// directory. Entries replace earlier ones for the same linter and rule.
+func (b *Base) Load(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	files := []string{path}
+	if info.IsDir() {
+		if files, err = filepath.Glob(filepath.Join(path, "*.json")); err != nil {
+			return err
+		}
+	}
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		if err := b.add(data, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Base) add(data []byte, source string) error {
+	var entries []Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("parse %s: %w", source, err)
+	}
+	for _, e := range entries {
+		if e.Linter == "" || e.Guideline == "" {
+			return fmt.Errorf("%s: entries need a linter and a guideline", source)
+		}
+		b.entries[e.key()] = e
+		if e.Rule != "" {
+			b.byRule[e.Rule] = e.key()
+		}
+	}
+	return nil
+}
+
+// Match returns the entries relevant to diags, in diagnostic order and
+// without duplicates. A rule-specific entry is preferred over the
+// linter-wide one.
+func (b *Base) Match(diags []types.Diagnostic) []Entry {
+	var matched []Entry
+	seen := make(map[string]bool)
+	for _, d := range diags {
+		e, ok := b.lookup(d)
+		if !ok || seen[e.key()] {
+			continue
+		}
+		seen[e.key()] = true
+		matched = append(matched, e)
+	}
+	return matched
+}
+
+func (b *Base) lookup(d types.Diagnostic) (Entry, bool) {
+	rule := ""
+	if m := ruleRe.FindStringSubmatch(d.Message); m != nil {
+		rule = m[1]
+	}
+	if e, ok := b.entries[d.Linter+"/"+rule]; ok && rule != "" {
+		return e, true
+	}
+	// Standalone tools such as staticcheck print the rule where
+	// golangci-lint prints the linter name.
+	if key, ok := b.byRule[d.Linter]; ok {
+		return b.entries[key], true
+	}
+	e, ok := b.entries[d.Linter+"/"]
+	return e, ok
+}
+
+// Format renders entries as a prompt section.
+func Format(entries []Entry) string {
+	var sb strings.Builder
+	for _, e := range entries {
+		name := e.Linter
+		if e.Rule != "" {
+			name += " " + e.Rule
+		}
+		fmt.Fprintf(&sb, "- %s: %s\n", name, e.Guideline)
+		if e.Before != "" && e.After != "" {
+			fmt.Fprintf(&sb, "  Before:\n%s\n  After:\n%s\n", indent(e.Before), indent(e.After))
+		}
+	}
+	return strings.TrimRight(sb.String(), "\n")
+}
+
+func indent(s string) string {
+	return "    " + strings.ReplaceAll(s, "\n", "\n    ")
+}
@@ -0,0 +1,149 @@
+package knowledge
+
+import (
+	"deeprefactor/internal/processor"
+	"deeprefactor/internal/types"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDefaultMatchesLinterOutput(t *testing.T) {
+	tests := []struct {
+		line string
+		want string // linter and rule of the entry, or "" for none
+	}{
+		{"main.go:12:10: Error return value of `os.Remove` is not checked (errcheck)", "errcheck/"},
+		{"main.go:5:6: exported: exported function Foo should have comment or be unexported (revive)", "revive/exported"},
+		{"main.go:8:2: var-naming: var userId should be userID (revive)", "revive/var-naming"},
+		{"main.go:9:1: unused-parameter: parameter 'ctx' seems to be unused, consider removing or renaming it as _ (revive)", "revive/unused-parameter"},
+		{"main.go:20:2: ifElseChain: rewrite if-else to switch statement (gocritic)", "gocritic/ifElseChain"},
+		{"main.go:21:2: appendAssign: append result not assigned to the same slice (gocritic)", ""},
+		{"main.go:4:2: SA1019: \"io/ioutil\" has been deprecated since Go 1.19 (staticcheck)", "staticcheck/SA1019"},
+		{"main.go:4:2: \"io/ioutil\" has been deprecated since Go 1.19 (SA1019)", "staticcheck/SA1019"},
+		{"main.go:7:3: undefined: foo (typecheck)", "typecheck/"},
+		{"main.go:7:3: something (nolintlint)", ""},
+	}
+	b := Default()
+	for _, tt := range tests {
+		diags := processor.ParseDiagnostics(tt.line)
+		if len(diags) != 1 {
+			t.Fatalf("ParseDiagnostics(%q) = %+v", tt.line, diags)
+		}
+		got := ""
+		if entries := b.Match(diags); len(entries) == 1 {
+			got = entries[0].key()
+		} else if len(entries) > 1 {
+			t.Errorf("%s matched %+v", tt.line, entries)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s matched %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestLoadDirectoryOverrides(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.json":    `[{"linter": "errcheck", "guideline": "team errcheck"}]`,
+		"b.json":    `[{"linter": "revive", "rule": "exported", "guideline": "team exported"}, {"linter": "mylinter", "guideline": "new"}]`,
+		"notes.txt": `not json`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b := Default()
+	if err := b.Load(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		diag types.Diagnostic
+		want string
+	}{
+		{types.Diagnostic{Linter: "errcheck", Message: "Error return value is not checked"}, "team errcheck"},
+		{types.Diagnostic{Linter: "revive", Message: "exported: exported function Foo should have comment"}, "team exported"},
+		{types.Diagnostic{Linter: "revive", Message: "var-naming: var userId should be userID"}, b.entries["revive/var-naming"].Guideline},
+		{types.Diagnostic{Linter: "mylinter", Message: "something"}, "new"},
+	}
+	for _, tt := range tests {
+		got := b.Match([]types.Diagnostic{tt.diag})
+		if len(got) != 1 || got[0].Guideline != tt.want {
+			t.Errorf("Match(%+v) = %+v, want %q", tt.diag, got, tt.want)
+		}
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	dir := t.TempDir()
+	tests := map[string]string{
+		"invalid.json":    `{"linter": "errcheck"}`,
+		"incomplete.json": `[{"linter": "errcheck"}]`,
+	}
+	for name, content := range tests {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := Default().Load(path); err == nil || !strings.Contains(err.Error(), path) {
+			t.Errorf("Load(%s) = %v, want an error naming the file", name, err)
+		}
+	}
+	if err := Default().Load(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("Load of a missing file succeeded")
+	}
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []Entry
+		want    string
+	}{
+		{"none", nil, ""},
+		{"linter", []Entry{{Linter: "errcheck", Guideline: "Handle it."}}, "- errcheck: Handle it."},
+		{"rule", []Entry{{Linter: "revive", Rule: "exported", Guideline: "Document it."}}, "- revive exported: Document it."},
+		{
+			"example",
+			[]Entry{{Linter: "gocritic", Rule: "elseif", Guideline: "Merge it.", Before: "} else {\n\tif x {", After: "} else if x {"}},
+			"- gocritic elseif: Merge it.\n  Before:\n    } else {\n    \tif x {\n  After:\n    } else if x {",
+		},
+		{"example needs both sides", []Entry{{Linter: "unused", Guideline: "Delete it.", Before: "var x int"}}, "- unused: Delete it."},
+		{
+			"several",
+			[]Entry{{Linter: "errcheck", Guideline: "Handle it."}, {Linter: "unused", Guideline: "Delete it."}},
+			"- errcheck: Handle it.\n- unused: Delete it.",
+		},
+	}
+	for _, tt := range tests {
+		if got := Format(tt.entries); got != tt.want {
+			t.Errorf("%s: Format = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMatchRuleAsLinterPrefersLastEntry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	rules := `[
+		{"linter": "staticcheck", "rule": "XX1000", "guideline": "first"},
+		{"linter": "gosimple", "rule": "XX1000", "guideline": "second"},
+		{"linter": "stylecheck", "rule": "XX1000", "guideline": "third"}
+	]`
+	if err := os.WriteFile(path, []byte(rules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b := Default()
+	if err := b.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		got := b.Match([]types.Diagnostic{{Linter: "XX1000", Message: "something"}})
+		if len(got) != 1 || got[0].Guideline != "third" {
+			t.Fatalf("Match = %+v, want the last entry", got)
+		}
+	}
+}
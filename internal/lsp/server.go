@@ -0,0 +1,484 @@
+// Package lsp is a Language Server Protocol front-end. It publishes lint
+// diagnostics for open Go files and offers a code action that asks the
+// model for a fix and returns it as a workspace edit.
+package lsp
+
+import (
+	"context"
+	"deeprefactor/internal/diff"
+	"deeprefactor/internal/types"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode/utf16"
+)
+
+// FixCommand is the command run by the code action for clients that
+// cannot resolve code action edits.
+const FixCommand = "deeprefactor.fix"
+
+const actionTitle = "Fix with DeepRefactor"
+
+// Report is the result of checking a file.
+type Report struct {
+	// Errors come from blocking checkers and Warnings from advisory ones.
+	Errors   []types.Diagnostic
+	Warnings []types.Diagnostic
+	// Output is the check output to give the model.
+	Output string
+}
+
+// Engine checks and fixes files for the server.
+type Engine interface {
+	// Check lints the file at path as saved on disk.
+	Check(ctx context.Context, path string) (Report, error)
+	// Fix returns content with the problems in report fixed. Progress
+	// messages go to log.
+	Fix(ctx context.Context, path, content string, report Report, log func(string)) (string, error)
+}
+
+type document struct {
+	text    string
+	version int
+	report  Report
+	// checked is the content of the file on disk that report describes.
+	// The fix is only offered while the buffer holds the same text.
+	checked string
+}
+
+// Server serves one client.
+type Server struct {
+	engine Engine
+	conn   *conn
+
+	mu       sync.Mutex
+	docs     map[string]*document
+	resolve  bool
+	shutdown bool
+	nextID   int
+	requests sync.WaitGroup
+}
+
+// Serve answers LSP messages from r on w until the client sends exit or r
+// ends.
+func Serve(ctx context.Context, r io.Reader, w io.Writer, engine Engine) error {
+	s := &Server{engine: engine, conn: newConn(r, w), docs: make(map[string]*document)}
+	defer s.requests.Wait()
+	// Pending checks and fixes are abandoned when the client goes away.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for {
+		msg, err := s.conn.read()
+		if err != nil {
+			var rerr *ResponseError
+			if errors.As(err, &rerr) {
+				s.conn.write(&message{ID: nullID(), Error: rerr})
+				continue
+			}
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if msg.Method == "" {
+			// A response to one of our requests, such as applyEdit.
+			continue
+		}
+		if msg.Method == "exit" {
+			return nil
+		}
+		if msg.ID == nil {
+			s.notify(ctx, msg)
+			continue
+		}
+		// Requests may take as long as a model call, so they run
+		// concurrently while notifications keep the documents current.
+		s.requests.Add(1)
+		go func() {
+			defer s.requests.Done()
+			result, err := s.call(ctx, msg)
+			s.reply(msg.ID, result, err)
+		}()
+	}
+}
+
+func nullID() *json.RawMessage {
+	id := json.RawMessage("null")
+	return &id
+}
+
+func (s *Server) reply(id *json.RawMessage, result any, err error) {
+	msg := &message{ID: id}
+	if err != nil {
+		var rerr *ResponseError
+		if !errors.As(err, &rerr) {
+			rerr = &ResponseError{Code: codeRequestFailed, Message: err.Error()}
+		}
+		msg.Error = rerr
+	} else {
+		data, merr := json.Marshal(result)
+		if merr != nil {
+			msg.Error = &ResponseError{Code: codeInternalError, Message: merr.Error()}
+		} else {
+			msg.Result = data
+		}
+	}
+	s.conn.write(msg)
+}
+
+func (s *Server) send(method string, params any) error {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return s.conn.write(&message{Method: method, Params: data})
+}
+
+// request sends a request to the client without waiting for the answer.
+func (s *Server) request(method string, params any) error {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.nextID++
+	id := json.RawMessage(fmt.Sprintf(`"deeprefactor-%d"`, s.nextID))
+	s.mu.Unlock()
+	return s.conn.write(&message{ID: &id, Method: method, Params: data})
+}
+
+func (s *Server) log(text string) {
+	s.send("window/logMessage", logMessageParams{Type: 3, Message: text})
+}
+
+func decode(msg *message, v any) error {
+	if err := json.Unmarshal(msg.Params, v); err != nil {
+		return &ResponseError{Code: codeInvalidParams, Message: err.Error()}
+	}
+	return nil
+}
+
+// notify handles a notification. Errors cannot be reported back, so they
+// are logged to the client.
+func (s *Server) notify(ctx context.Context, msg *message) {
+	switch msg.Method {
+	case "textDocument/didOpen":
+		var p didOpenParams
+		if decode(msg, &p) != nil {
+			return
+		}
+		s.mu.Lock()
+		s.docs[p.TextDocument.URI] = &document{text: p.TextDocument.Text, version: p.TextDocument.Version}
+		s.mu.Unlock()
+		s.check(ctx, p.TextDocument.URI)
+
+	case "textDocument/didChange":
+		var p didChangeParams
+		if decode(msg, &p) != nil || len(p.ContentChanges) == 0 {
+			return
+		}
+		s.mu.Lock()
+		if doc, ok := s.docs[p.TextDocument.URI]; ok {
+			// The server asks for full document sync.
+			doc.text = p.ContentChanges[len(p.ContentChanges)-1].Text
+			doc.version = p.TextDocument.Version
+			doc.report = Report{}
+		}
+		s.mu.Unlock()
+
+	case "textDocument/didSave":
+		var p documentParams
+		if decode(msg, &p) == nil {
+			s.check(ctx, p.TextDocument.URI)
+		}
+
+	case "textDocument/didClose":
+		var p documentParams
+		if decode(msg, &p) != nil {
+			return
+		}
+		s.mu.Lock()
+		delete(s.docs, p.TextDocument.URI)
+		s.mu.Unlock()
+		s.send("textDocument/publishDiagnostics", publishDiagnosticsParams{URI: p.TextDocument.URI, Diagnostics: []Diagnostic{}})
+	}
+}
+
+// check lints the saved file of uri in the background and publishes the
+// diagnostics.
+func (s *Server) check(ctx context.Context, uri string) {
+	path, err := uriPath(uri)
+	if err != nil {
+		s.log(err.Error())
+		return
+	}
+	s.requests.Add(1)
+	go func() {
+		defer s.requests.Done()
+		before, err := os.ReadFile(path)
+		if err != nil {
+			s.log(fmt.Sprintf("check %s: %v", path, err))
+			return
+		}
+		report, err := s.engine.Check(ctx, path)
+		if err != nil {
+			s.log(fmt.Sprintf("check %s: %v", path, err))
+			return
+		}
+		if after, err := os.ReadFile(path); err != nil || string(after) != string(before) {
+			// The file was saved again during the check, which starts
+			// another one.
+			return
+		}
+
+		s.mu.Lock()
+		doc, ok := s.docs[uri]
+		if !ok {
+			s.mu.Unlock()
+			return
+		}
+		doc.report, doc.checked = report, string(before)
+		version, text := doc.version, doc.text
+		s.mu.Unlock()
+
+		diags := []Diagnostic{}
+		for _, d := range report.Errors {
+			diags = append(diags, toDiagnostic(text, d, SeverityError))
+		}
+		for _, d := range report.Warnings {
+			diags = append(diags, toDiagnostic(text, d, SeverityWarning))
+		}
+		s.send("textDocument/publishDiagnostics", publishDiagnosticsParams{URI: uri, Version: version, Diagnostics: diags})
+	}()
+}
+
+func (s *Server) call(ctx context.Context, msg *message) (any, error) {
+	s.mu.Lock()
+	shutdown := s.shutdown
+	s.mu.Unlock()
+	if shutdown {
+		return nil, &ResponseError{Code: codeInvalidRequest, Message: "the server is shut down"}
+	}
+
+	switch msg.Method {
+	case "initialize":
+		var p initializeParams
+		if err := decode(msg, &p); err != nil {
+			return nil, err
+		}
+		if rs := p.Capabilities.TextDocument.CodeAction.ResolveSupport; rs != nil {
+			for _, prop := range rs.Properties {
+				if prop == "edit" {
+					s.mu.Lock()
+					s.resolve = true
+					s.mu.Unlock()
+				}
+			}
+		}
+		return map[string]any{
+			"capabilities": map[string]any{
+				"textDocumentSync":       map[string]any{"openClose": true, "change": 1, "save": map[string]any{}},
+				"codeActionProvider":     map[string]any{"codeActionKinds": []string{"quickfix"}, "resolveProvider": true},
+				"executeCommandProvider": map[string]any{"commands": []string{FixCommand}},
+			},
+			"serverInfo": map[string]any{"name": "deeprefactor"},
+		}, nil
+
+	case "shutdown":
+		s.mu.Lock()
+		s.shutdown = true
+		s.mu.Unlock()
+		return nil, nil
+
+	case "textDocument/codeAction":
+		var p codeActionParams
+		if err := decode(msg, &p); err != nil {
+			return nil, err
+		}
+		return s.codeActions(p), nil
+
+	case "codeAction/resolve":
+		var action CodeAction
+		if err := decode(msg, &action); err != nil {
+			return nil, err
+		}
+		if action.Data == nil {
+			return action, nil
+		}
+		edit, err := s.fix(ctx, *action.Data)
+		if err != nil {
+			return nil, err
+		}
+		action.Edit = edit
+		return action, nil
+
+	case "workspace/executeCommand":
+		var p executeCommandParams
+		if err := decode(msg, &p); err != nil {
+			return nil, err
+		}
+		var data actionData
+		if p.Command != FixCommand || len(p.Arguments) != 1 || json.Unmarshal(p.Arguments[0], &data) != nil {
+			return nil, &ResponseError{Code: codeInvalidParams, Message: "unknown command " + p.Command}
+		}
+		edit, err := s.fix(ctx, data)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.request("workspace/applyEdit", applyEditParams{Label: actionTitle, Edit: *edit})
+	}
+	return nil, &ResponseError{Code: codeMethodNotFound, Message: "method not supported: " + msg.Method}
+}
+
+// codeActions offers the fix for documents with lint errors.
+func (s *Server) codeActions(p codeActionParams) []CodeAction {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	doc, ok := s.docs[p.TextDocument.URI]
+	if !ok || len(doc.report.Errors) == 0 || doc.text != doc.checked {
+		return []CodeAction{}
+	}
+	data := actionData{URI: p.TextDocument.URI, Version: doc.version}
+	action := CodeAction{Title: actionTitle, Kind: "quickfix", Diagnostics: p.Context.Diagnostics}
+	if s.resolve {
+		action.Data = &data
+	} else {
+		arg, _ := json.Marshal(data)
+		action.Command = &Command{Title: actionTitle, Command: FixCommand, Arguments: []json.RawMessage{arg}}
+	}
+	return []CodeAction{action}
+}
+
+// fix runs the engine on the document and returns the edit turning it into
+// the fixed code.
+func (s *Server) fix(ctx context.Context, data actionData) (*WorkspaceEdit, error) {
+	path, err := uriPath(data.URI)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	doc, ok := s.docs[data.URI]
+	if !ok {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("%s is not open", path)
+	}
+	text, version, report, checked := doc.text, doc.version, doc.report, doc.checked
+	s.mu.Unlock()
+	if version != data.Version {
+		return nil, errors.New("the document changed since the code action was offered")
+	}
+	if text != checked || len(report.Errors) == 0 {
+		return nil, errors.New("the document differs from the checked file; save it to check it again")
+	}
+
+	fixed, err := s.engine.Fix(ctx, path, text, report, s.log)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	changed := doc.version != version
+	s.mu.Unlock()
+	if changed {
+		return nil, errors.New("the document changed while it was being fixed")
+	}
+	return &WorkspaceEdit{Changes: map[string][]TextEdit{data.URI: Edits(text, fixed)}}, nil
+}
+
+// Edits returns the line edits turning text into fixed. Inserted lines use
+// the line ending of text.
+func Edits(text, fixed string) []TextEdit {
+	eol := "\n"
+	if strings.Contains(text, "\r\n") {
+		eol = "\r\n"
+	}
+	old := diff.SplitLines(text)
+	if !strings.HasSuffix(text, "\n") && len(old) > 0 {
+		// Line-based edits cannot address the end of an unterminated last
+		// line, so replace the whole document.
+		last := old[len(old)-1]
+		end := Position{Line: len(old) - 1, Character: utf16Len(last)}
+		return []TextEdit{{Range: Range{End: end}, NewText: strings.ReplaceAll(strings.ReplaceAll(fixed, "\r\n", "\n"), "\n", eol)}}
+	}
+
+	var edits []TextEdit
+	var cur *TextEdit
+	var lines []string
+	line := 0
+	flush := func() {
+		if cur != nil {
+			cur.Range.End = Position{Line: line}
+			if len(lines) > 0 {
+				cur.NewText = strings.Join(lines, eol) + eol
+			}
+			edits = append(edits, *cur)
+			cur, lines = nil, nil
+		}
+	}
+	for _, op := range diff.Lines(old, diff.SplitLines(fixed)) {
+		switch op.Kind {
+		case diff.Equal:
+			flush()
+			line++
+		case diff.Delete:
+			if cur == nil {
+				cur = &TextEdit{Range: Range{Start: Position{Line: line}}}
+			}
+			line++
+		case diff.Insert:
+			if cur == nil {
+				cur = &TextEdit{Range: Range{Start: Position{Line: line}}}
+			}
+			lines = append(lines, op.Text)
+		}
+	}
+	flush()
+	return edits
+}
+
+// toDiagnostic converts d, whose line and byte column are 1-based, to an
+// LSP diagnostic spanning from the column to the end of the line.
+func toDiagnostic(text string, d types.Diagnostic, severity int) Diagnostic {
+	lines := diff.SplitLines(text)
+	line := max(d.Line-1, 0)
+	var content string
+	if line < len(lines) {
+		content = lines[line]
+	}
+	col := min(max(d.Column-1, 0), len(content))
+	return Diagnostic{
+		Range: Range{
+			Start: Position{Line: line, Character: utf16Len(content[:col])},
+			End:   Position{Line: line, Character: utf16Len(content)},
+		},
+		Severity: severity,
+		Code:     d.Linter,
+		Source:   "deeprefactor",
+		Message:  d.Message,
+	}
+}
+
+func utf16Len(s string) int {
+	return len(utf16.Encode([]rune(s)))
+}
+
+// uriPath returns the path of a file URI.
+func uriPath(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return "", fmt.Errorf("unsupported document URI %q", uri)
+	}
+	path := u.Path
+	if len(path) >= 3 && path[0] == '/' && path[2] == ':' {
+		// file:///C:/dir on Windows.
+		path = path[1:]
+	}
+	return filepath.FromSlash(path), nil
+}
@@ -0,0 +1,249 @@
+package lsp
+
+import (
+	"context"
+	"deeprefactor/internal/types"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	source = "package a\n\nfunc f() {\n\tx := 1\n}\n"
+	fixed  = "package a\n\nfunc f() {\n}\n"
+)
+
+type fakeEngine struct{}
+
+func (fakeEngine) Check(ctx context.Context, path string) (Report, error) {
+	return Report{
+		Errors: []types.Diagnostic{{File: path, Line: 4, Column: 2, Message: "declared and not used: x", Linter: "vet"}},
+		Output: path + ":4:2: declared and not used: x",
+	}, nil
+}
+
+func (fakeEngine) Fix(ctx context.Context, path, content string, report Report, log func(string)) (string, error) {
+	log("fixing " + filepath.Base(path))
+	return strings.Replace(content, "\tx := 1\n", "", 1), nil
+}
+
+// client is a scripted LSP client talking to a server over pipes.
+type client struct {
+	t     *testing.T
+	conn  *conn
+	queue chan *message
+	// skipped holds the messages passed over while awaiting others.
+	skipped []*message
+	nextID  int
+}
+
+func start(t *testing.T) *client {
+	t.Helper()
+	toServer, fromClient := io.Pipe()
+	fromServer, toClient := io.Pipe()
+	done := make(chan error, 1)
+	go func() { done <- Serve(context.Background(), toServer, toClient, fakeEngine{}) }()
+
+	c := &client{t: t, conn: newConn(fromServer, fromClient), queue: make(chan *message, 100)}
+	go func() {
+		for {
+			msg, err := c.conn.read()
+			if err != nil {
+				close(c.queue)
+				return
+			}
+			c.queue <- msg
+		}
+	}()
+	t.Cleanup(func() {
+		c.notify("exit", nil)
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+		fromClient.Close()
+		toClient.Close()
+	})
+	return c
+}
+
+func (c *client) notify(method string, params any) {
+	data, _ := json.Marshal(params)
+	if err := c.conn.write(&message{Method: method, Params: data}); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// call sends a request and decodes its result into result.
+func (c *client) call(method string, params any, result any) {
+	c.t.Helper()
+	c.nextID++
+	id := json.RawMessage(strings.Repeat("1", c.nextID))
+	data, _ := json.Marshal(params)
+	if err := c.conn.write(&message{ID: &id, Method: method, Params: data}); err != nil {
+		c.t.Fatal(err)
+	}
+	msg := c.await(func(m *message) bool { return m.Method == "" && m.ID != nil && string(*m.ID) == string(id) })
+	if msg.Error != nil {
+		c.t.Fatalf("%s: %v", method, msg.Error)
+	}
+	if result != nil {
+		if err := json.Unmarshal(msg.Result, result); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+}
+
+func (c *client) await(match func(*message) bool) *message {
+	c.t.Helper()
+	for i, msg := range c.skipped {
+		if match(msg) {
+			c.skipped = append(c.skipped[:i], c.skipped[i+1:]...)
+			return msg
+		}
+	}
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case msg, ok := <-c.queue:
+			if !ok {
+				c.t.Fatal("server closed the connection")
+			}
+			if match(msg) {
+				return msg
+			}
+			c.skipped = append(c.skipped, msg)
+		case <-timeout:
+			c.t.Fatal("timed out waiting for the server")
+		}
+	}
+}
+
+func (c *client) open(resolve bool) (uri string) {
+	caps := map[string]any{}
+	if resolve {
+		caps = map[string]any{"textDocument": map[string]any{"codeAction": map[string]any{"resolveSupport": map[string]any{"properties": []string{"edit"}}}}}
+	}
+	c.call("initialize", map[string]any{"capabilities": caps}, nil)
+	c.notify("initialized", map[string]any{})
+
+	path := filepath.Join(c.t.TempDir(), "a.go")
+	if err := os.WriteFile(path, []byte(source), 0644); err != nil {
+		c.t.Fatal(err)
+	}
+	uri = "file://" + filepath.ToSlash(path)
+	c.notify("textDocument/didOpen", map[string]any{"textDocument": map[string]any{"uri": uri, "languageId": "go", "version": 1, "text": source}})
+
+	msg := c.await(func(m *message) bool { return m.Method == "textDocument/publishDiagnostics" })
+	var p publishDiagnosticsParams
+	json.Unmarshal(msg.Params, &p)
+	want := Range{Start: Position{Line: 3, Character: 1}, End: Position{Line: 3, Character: 7}}
+	if len(p.Diagnostics) != 1 || p.Diagnostics[0].Range != want || p.Diagnostics[0].Severity != SeverityError {
+		c.t.Fatalf("diagnostics = %+v", p.Diagnostics)
+	}
+	return uri
+}
+
+func (c *client) codeAction(uri string) CodeAction {
+	var actions []CodeAction
+	c.call("textDocument/codeAction", map[string]any{
+		"textDocument": map[string]any{"uri": uri},
+		"range":        Range{Start: Position{Line: 3}, End: Position{Line: 3}},
+		"context":      map[string]any{"diagnostics": []Diagnostic{}},
+	}, &actions)
+	if len(actions) != 1 || actions[0].Title != actionTitle {
+		c.t.Fatalf("code actions = %+v", actions)
+	}
+	return actions[0]
+}
+
+func TestCodeActionResolve(t *testing.T) {
+	c := start(t)
+	uri := c.open(true)
+	action := c.codeAction(uri)
+	if action.Data == nil || action.Edit != nil {
+		t.Fatalf("unresolved action = %+v", action)
+	}
+
+	var resolved CodeAction
+	c.call("codeAction/resolve", action, &resolved)
+	if resolved.Edit == nil {
+		t.Fatal("resolved action has no edit")
+	}
+	if got := apply(source, resolved.Edit.Changes[uri]); got != fixed {
+		t.Errorf("edited document = %q, want %q", got, fixed)
+	}
+}
+
+func TestCodeActionCommand(t *testing.T) {
+	c := start(t)
+	uri := c.open(false)
+	action := c.codeAction(uri)
+	if action.Command == nil || action.Command.Command != FixCommand {
+		t.Fatalf("action = %+v", action)
+	}
+
+	c.call("workspace/executeCommand", map[string]any{"command": FixCommand, "arguments": action.Command.Arguments}, nil)
+	msg := c.await(func(m *message) bool { return m.Method == "workspace/applyEdit" })
+	var p applyEditParams
+	json.Unmarshal(msg.Params, &p)
+	if got := apply(source, p.Edit.Changes[uri]); got != fixed {
+		t.Errorf("edited document = %q, want %q", got, fixed)
+	}
+}
+
+func TestNoActionForUnsavedChanges(t *testing.T) {
+	c := start(t)
+	uri := c.open(true)
+	c.notify("textDocument/didChange", map[string]any{
+		"textDocument":   map[string]any{"uri": uri, "version": 2},
+		"contentChanges": []map[string]any{{"text": source + "// edited\n"}},
+	})
+
+	var actions []CodeAction
+	c.call("textDocument/codeAction", map[string]any{
+		"textDocument": map[string]any{"uri": uri},
+		"range":        Range{Start: Position{Line: 3}, End: Position{Line: 3}},
+		"context":      map[string]any{"diagnostics": []Diagnostic{}},
+	}, &actions)
+	if len(actions) != 0 {
+		t.Errorf("code actions for an unsaved buffer = %+v", actions)
+	}
+}
+
+func TestEdits(t *testing.T) {
+	tests := []struct{ name, text, fixed string }{
+		{"lf", source, fixed},
+		{"crlf", strings.ReplaceAll(source, "\n", "\r\n"), strings.ReplaceAll(fixed+"// end\n", "\n", "\r\n")},
+		{"insert at end", source, source + "\nfunc g() {}\n"},
+		{"unterminated", strings.TrimSuffix(source, "\n"), fixed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := apply(tt.text, Edits(tt.text, tt.fixed)); got != tt.fixed {
+				t.Errorf("edited = %q, want %q", got, tt.fixed)
+			}
+		})
+	}
+}
+
+// apply applies edits to ASCII text.
+func apply(text string, edits []TextEdit) string {
+	lines := strings.SplitAfter(text, "\n")
+	offset := func(p Position) int {
+		n := 0
+		for _, l := range lines[:min(p.Line, len(lines))] {
+			n += len(l)
+		}
+		return n + p.Character
+	}
+	sort.Slice(edits, func(i, j int) bool { return offset(edits[i].Range.Start) > offset(edits[j].Range.Start) })
+	for _, e := range edits {
+		text = text[:offset(e.Range.Start)] + e.NewText + text[offset(e.Range.End):]
+	}
+	return text
+}
@@ -0,0 +1,247 @@
+package processor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+var (
+	envAssignRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+	// shellOperators are characters that only make sense to a real shell.
+	shellOperators = "|&;<>()`"
+)
+
+// Command is a parsed lint command ready to run.
+type Command struct {
+	Args []string
+	Env  []string
+	// Dir is the working directory; empty means the current one.
+	Dir string
+}
+
+// placeholderKeys lists the placeholders in the order they are expanded.
+var placeholderKeys = []string{"{{filepath}}", "{{dir}}", "{{package}}", "{{module}}", "{{relpath}}"}
+
+// Placeholders returns the values substituted into command templates for
+// target, which may be a file or a package directory.
+func Placeholders(target string) map[string]string {
+	dir := target
+	if info, err := os.Stat(target); err != nil || !info.IsDir() {
+		dir = filepath.Dir(target)
+	}
+	// Without a module, the package is the directory as a relative
+	// pattern, which needs a leading "./" unless it starts with a dot.
+	pkg := filepath.ToSlash(filepath.Clean(dir))
+	if pkg != "." && pkg != ".." && !strings.HasPrefix(pkg, "../") {
+		pkg = "./" + pkg
+	}
+	values := map[string]string{
+		"{{filepath}}": target,
+		"{{dir}}":      dir,
+		"{{package}}":  pkg,
+		"{{module}}":   "",
+		"{{relpath}}":  target,
+	}
+	if filepath.IsAbs(dir) {
+		values["{{package}}"] = dir
+	}
+
+	root, module, err := FindModule(dir)
+	if err != nil {
+		return values
+	}
+	values["{{module}}"] = module
+	absTarget, _ := filepath.Abs(target)
+	absDir, _ := filepath.Abs(dir)
+	if rel, err := filepath.Rel(root, absTarget); err == nil {
+		values["{{relpath}}"] = filepath.ToSlash(rel)
+	}
+	if rel, err := filepath.Rel(root, absDir); err == nil {
+		values["{{package}}"] = module
+		if rel != "." {
+			values["{{package}}"] = module + "/" + filepath.ToSlash(rel)
+		}
+	}
+	return values
+}
+
+// ExpandPlaceholders replaces every placeholder occurrence in s.
+func ExpandPlaceholders(s, target string) string {
+	return expand(s, Placeholders(target), noQuote)
+}
+
+// expand replaces the placeholders in a single pass, so a value that
+// contains a placeholder name is not expanded again.
+func expand(s string, values map[string]string, quote func(string) string) string {
+	pairs := make([]string, 0, 2*len(placeholderKeys))
+	for _, key := range placeholderKeys {
+		pairs = append(pairs, key, quote(values[key]))
+	}
+	return strings.NewReplacer(pairs...).Replace(s)
+}
+
+// BuildCommand turns a command template into a Command for target. The
+// template is split into words like a POSIX shell would, leading NAME=value
+// words become environment variables, and placeholders are expanded inside
+// each word so that paths containing spaces stay a single argument. With
+// shell set, the template is instead run through "sh -c" (or "cmd /C" on
+// Windows) with quoted placeholder values, which allows pipes and
+// redirections.
+func BuildCommand(template, target string, shell bool) (Command, error) {
+	values := Placeholders(target)
+	if shell {
+		if runtime.GOOS == "windows" {
+			return Command{Args: []string{"cmd", "/C", expand(template, values, windowsQuote)}}, nil
+		}
+		return Command{Args: []string{"sh", "-c", expand(template, values, shellQuote)}}, nil
+	}
+
+	words, err := SplitCommand(template)
+	if err != nil {
+		return Command{}, err
+	}
+	var cmd Command
+	for len(words) > 0 && envAssignRe.MatchString(words[0]) {
+		cmd.Env = append(cmd.Env, expand(words[0], values, noQuote))
+		words = words[1:]
+	}
+	if len(words) == 0 {
+		return Command{}, errors.New("lint command is empty")
+	}
+	for _, w := range words {
+		cmd.Args = append(cmd.Args, expand(w, values, noQuote))
+	}
+	return cmd, nil
+}
+
+// SplitCommand splits s into words using shell quoting rules: single quotes
+// are literal, double quotes allow backslash escapes of \ " $ and `, and a
+// backslash outside quotes escapes the next character. Unquoted shell
+// operators such as pipes are rejected.
+func SplitCommand(s string) ([]string, error) {
+	var words []string
+	var cur strings.Builder
+	inWord := false
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if inWord {
+				words = append(words, cur.String())
+				cur.Reset()
+				inWord = false
+			}
+		case c == '\\':
+			inWord = true
+			if i+1 < len(s) {
+				i++
+				cur.WriteByte(s[i])
+			}
+		case c == '\'':
+			inWord = true
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated single quote in %q", s)
+			}
+			cur.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+		case c == '"':
+			inWord = true
+			closed := false
+			for i++; i < len(s); i++ {
+				if s[i] == '"' {
+					closed = true
+					break
+				}
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("\\\"$`", s[i+1]) >= 0 {
+					i++
+				}
+				cur.WriteByte(s[i])
+			}
+			if !closed {
+				return nil, fmt.Errorf("unterminated double quote in %q", s)
+			}
+		case strings.IndexByte(shellOperators, c) >= 0:
+			return nil, fmt.Errorf("lint command contains shell operator %q; quote it or enable --shell", string(c))
+		default:
+			inWord = true
+			cur.WriteByte(c)
+		}
+	}
+	if inWord {
+		words = append(words, cur.String())
+	}
+	return words, nil
+}
+
+func noQuote(s string) string {
+	return s
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func windowsQuote(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
+
+func (c Command) String() string {
+	return strings.Join(append(append([]string{}, c.Env...), c.Args...), " ")
+}
+
+// Run executes the command and returns its combined stderr and stdout.
+func (c Command) Run(ctx context.Context) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.Args[0], c.Args[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.Dir = c.Dir
+	if len(c.Env) > 0 {
+		cmd.Env = append(os.Environ(), c.Env...)
+	}
+
+	err := cmd.Run()
+	output := strings.TrimSpace(stderr.String() + stdout.String())
+
+	if err != nil {
+		return output, fmt.Errorf("lint failed: %w", err)
+	}
+	return output, nil
+}
+
+// FindModule walks up from dir to the nearest go.mod and returns the module
+// root directory and module path.
+func FindModule(dir string) (string, string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", "", err
+	}
+	for d := abs; ; d = filepath.Dir(d) {
+		f, err := os.Open(filepath.Join(d, "go.mod"))
+		if err == nil {
+			defer f.Close()
+			scanner := bufio.NewScanner(f)
+			for scanner.Scan() {
+				line := strings.TrimSpace(scanner.Text())
+				if rest, ok := strings.CutPrefix(line, "module"); ok && (rest == "" || rest[0] == ' ' || rest[0] == '\t' || rest[0] == '"') {
+					return d, strings.Trim(strings.TrimSpace(rest), `"`), nil
+				}
+			}
+			return "", "", fmt.Errorf("no module directive in %s", filepath.Join(d, "go.mod"))
+		}
+		if filepath.Dir(d) == d {
+			return "", "", fmt.Errorf("no go.mod found above %s", dir)
+		}
+	}
+}
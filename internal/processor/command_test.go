@@ -0,0 +1,47 @@
+package processor
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExpandPlaceholdersOnce(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "{{dir}}")
+	target := filepath.Join(dir, "a.go")
+	want := target + " " + dir
+	for i := 0; i < 10; i++ {
+		if got := ExpandPlaceholders("{{filepath}} {{dir}}", target); got != want {
+			t.Fatalf("ExpandPlaceholders = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestPackagePlaceholderWithoutModule(t *testing.T) {
+	root := t.TempDir()
+	work := filepath.Join(root, "work")
+	if err := os.Mkdir(work, 0755); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(work); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	tests := map[string]string{
+		"a.go":         ".",
+		"sub/a.go":     "./sub",
+		".hidden/a.go": "./.hidden",
+		"../a.go":      "..",
+		"../x/a.go":    "../x",
+	}
+	for target, want := range tests {
+		if got := Placeholders(filepath.FromSlash(target))["{{package}}"]; got != want {
+			t.Errorf("{{package}} of %s = %q, want %q", target, got, want)
+		}
+	}
+}
@@ -1,14 +1,22 @@
 package processor
 
 import (
-	"bytes"
 	"context"
 	"deeprefactor/internal/types"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
+)
+
+var (
+	diagnosticRe = regexp.MustCompile(`^(?:[\w-]+: )?((?:[A-Za-z]:)?[^\s:]+\.go):(\d+)(?::(\d+))?:\s*(.*)$`)
+	linterRe     = regexp.MustCompile(`\s\(([\w-]+)\)$`)
 )
 
 func FindGoFiles(dir string) ([]*types.FileProcess, error) {
@@ -28,20 +36,117 @@ func FindGoFiles(dir string) ([]*types.FileProcess, error) {
 	return files, err
 }
 
-func RunLintCommand(ctx context.Context, cmd string) (string, error) {
-	parts := strings.Split(cmd, " ")
-	var stdout, stderr bytes.Buffer
-	c := exec.CommandContext(ctx, parts[0], parts[1:]...)
-	c.Stdout = &stdout
-	c.Stderr = &stderr
+// RunLintCommand expands the command template for target and runs it. See
+// BuildCommand for the supported syntax.
+func RunLintCommand(ctx context.Context, template, target string, shell bool) (string, error) {
+	cmd, err := BuildCommand(template, target, shell)
+	if err != nil {
+		return "", err
+	}
+	return cmd.Run(ctx)
+}
 
-	err := c.Run()
-	output := strings.TrimSpace(stderr.String() + stdout.String())
+// ParseDiagnostics extracts "file:line:col: message" entries from lint
+// output. A trailing "(linter)" as printed by golangci-lint is split off
+// into Linter.
+func ParseDiagnostics(output string) []types.Diagnostic {
+	var diags []types.Diagnostic
+	for _, line := range strings.Split(output, "\n") {
+		m := diagnosticRe.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+		d := types.Diagnostic{File: m[1], Message: m[4]}
+		d.Line, _ = strconv.Atoi(m[2])
+		d.Column, _ = strconv.Atoi(m[3])
+		if lm := linterRe.FindStringSubmatch(d.Message); lm != nil {
+			d.Linter = lm[1]
+			d.Message = strings.TrimSuffix(d.Message, lm[0])
+		}
+		diags = append(diags, d)
+	}
+	return diags
+}
 
-	if err != nil {
-		return output, fmt.Errorf("lint failed: %w", err)
+// SameFile reports whether two paths, possibly relative, name the same file.
+func SameFile(a, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	if errA != nil || errB != nil {
+		return filepath.Clean(a) == filepath.Clean(b)
+	}
+	return absA == absB
+}
+
+// VerifyPackage builds the package in dir and runs its tests, optionally
+// restricted to the tests matching runFilter. The combined output of the
+// failing step is returned with the error.
+func VerifyPackage(ctx context.Context, dir, runFilter string, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	steps := [][]string{
+		{"go", "build", "-o", os.DevNull, "."},
+		{"go", "test", "-count=1", "-timeout", timeout.String()},
+	}
+	if runFilter != "" {
+		steps[1] = append(steps[1], "-run", runFilter)
+	}
+	steps[1] = append(steps[1], ".")
+
+	for _, step := range steps {
+		c := exec.CommandContext(ctx, step[0], step[1:]...)
+		c.Dir = dir
+		out, err := c.CombinedOutput()
+		if err != nil {
+			return strings.TrimSpace(string(out)), &StepError{Step: step[1], Err: err}
+		}
+	}
+	return "", nil
+}
+
+// StepError is returned by VerifyPackage when its "build" or "test" step
+// fails.
+type StepError struct {
+	Step string
+	Err  error
+}
+
+func (e *StepError) Error() string {
+	return fmt.Sprintf("go %s failed: %v", e.Step, e.Err)
+}
+
+func (e *StepError) Unwrap() error {
+	return e.Err
+}
+
+// Failures lists the failures in the result of VerifyPackage so that two
+// runs can be compared: the compiler errors by file and message, leaving out
+// positions that edits move, and the names of the failing tests. Each is
+// prefixed with the step that reported it, such as "test: FAIL TestA". A
+// failure without either is listed by its error. Nil means the run passed.
+func Failures(output string, err error) []string {
+	if err == nil {
+		return nil
+	}
+	step := "verify"
+	var se *StepError
+	if errors.As(err, &se) {
+		step = se.Step
+	}
+	var failures []string
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if m := diagnosticRe.FindStringSubmatch(line); m != nil {
+			failures = append(failures, step+": "+filepath.Base(m[1])+": "+m[4])
+		} else if name, ok := strings.CutPrefix(line, "--- FAIL: "); ok {
+			failures = append(failures, step+": FAIL "+strings.Fields(name)[0])
+		}
+	}
+	if len(failures) == 0 {
+		failures = append(failures, step+": "+err.Error())
 	}
-	return output, nil
+	return failures
 }
 
 func ShortPath(path string) string {
@@ -0,0 +1,22 @@
+package processor
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestFailures(t *testing.T) {
+	output := "# a\n./a.go:12:3: undefined: x\n--- FAIL: TestA (0.00s)\n    a_test.go:9: got 1\n--- FAIL: TestB/sub (0.01s)\nFAIL\n"
+	got := Failures(output, &StepError{Step: "test", Err: errors.New("exit status 1")})
+	want := []string{"test: a.go: undefined: x", "test: FAIL TestA", "test: a_test.go: got 1", "test: FAIL TestB/sub"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Failures = %q, want %q", got, want)
+	}
+	if got := Failures("killed", &StepError{Step: "build", Err: errors.New("signal: killed")}); !reflect.DeepEqual(got, []string{"build: go build failed: signal: killed"}) {
+		t.Errorf("Failures without known lines = %q", got)
+	}
+	if got := Failures("", nil); got != nil {
+		t.Errorf("Failures of a passing run = %q", got)
+	}
+}
@@ -0,0 +1,75 @@
+package processor
+
+import (
+	"deeprefactor/internal/types"
+	"go/ast"
+	"go/build"
+	"go/importer"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	gotypes "go/types"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// TypeCheck parses and type-checks the non-test Go files in dir that match
+// the build constraints of the current platform as a single package and
+// returns every syntax or type error found. Imports are
+// type-checked from source, so packages from the module cache resolve.
+func TypeCheck(dir string) ([]types.Diagnostic, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	fset := token.NewFileSet()
+	var files []*ast.File
+	var diags []types.Diagnostic
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		// A file whose header does not parse is kept to report the error.
+		if match, err := build.Default.MatchFile(dir, name); err == nil && !match {
+			continue
+		}
+		f, err := parser.ParseFile(fset, filepath.Join(dir, name), nil, parser.AllErrors)
+		if err != nil {
+			if list, ok := err.(scanner.ErrorList); ok {
+				for _, e := range list {
+					diags = append(diags, diagnosticAt(e.Pos, e.Msg))
+				}
+				continue
+			}
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	if len(files) == 0 {
+		return diags, nil
+	}
+
+	conf := gotypes.Config{
+		Importer: importer.ForCompiler(fset, "source", nil),
+		Error: func(err error) {
+			if te, ok := err.(gotypes.Error); ok {
+				diags = append(diags, diagnosticAt(te.Fset.Position(te.Pos), te.Msg))
+			}
+		},
+	}
+	conf.Check(files[0].Name.Name, fset, files, nil)
+	return diags, nil
+}
+
+func diagnosticAt(pos token.Position, msg string) types.Diagnostic {
+	return types.Diagnostic{
+		File:    pos.Filename,
+		Line:    pos.Line,
+		Column:  pos.Column,
+		Message: msg,
+		Linter:  "typecheck",
+	}
+}
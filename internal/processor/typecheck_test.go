@@ -0,0 +1,39 @@
+package processor
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTypeCheckThirdPartyImports(t *testing.T) {
+	// The TUI imports bubbletea and lipgloss from the module cache.
+	diags, err := TypeCheck("../tui")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range diags {
+		t.Errorf("unexpected diagnostic: %s", d)
+	}
+}
+
+func TestTypeCheckBuildConstraints(t *testing.T) {
+	dir := t.TempDir()
+	sources := map[string]string{
+		"a.go":       "package a\n\nfunc F() int { return 1 }\n",
+		"a_other.go": "//go:build never\n\npackage a\n\nfunc F() int { return 2 }\n",
+		"a_plan9.go": "package a\n\nfunc F() int { return undefined }\n",
+	}
+	for name, src := range sources {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	diags, err := TypeCheck(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range diags {
+		t.Errorf("unexpected diagnostic: %s", d)
+	}
+}
@@ -0,0 +1,213 @@
+package tui
+
+import (
+	"deeprefactor/internal/diff"
+	"deeprefactor/internal/types"
+	"fmt"
+	"go/scanner"
+	"go/token"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/lipgloss"
+)
+
+type viewMode int
+
+const (
+	logMode viewMode = iota
+	diffMode
+	diagnosticsMode
+)
+
+func (v viewMode) String() string {
+	switch v {
+	case diffMode:
+		return "diff"
+	case diagnosticsMode:
+		return "diagnostics"
+	default:
+		return "log"
+	}
+}
+
+func (v viewMode) next() viewMode {
+	return (v + 1) % 3
+}
+
+var (
+	diffAddStyle     = lipgloss.NewStyle().Foreground(lipgloss.Color("#5FD75F"))
+	diffDelStyle     = lipgloss.NewStyle().Foreground(lipgloss.Color("#FF5F5F"))
+	diffHunkStyle    = lipgloss.NewStyle().Foreground(lipgloss.Color("#5FAFFF"))
+	diffGutterStyle  = lipgloss.NewStyle().Foreground(lipgloss.Color("#6C6C6C"))
+	diagMarkerStyle  = lipgloss.NewStyle().Foreground(lipgloss.Color("#FF8700")).Bold(true)
+	syntaxKeyword    = lipgloss.NewStyle().Foreground(lipgloss.Color("#AF87FF"))
+	syntaxString     = lipgloss.NewStyle().Foreground(lipgloss.Color("#D7AF5F"))
+	syntaxComment    = lipgloss.NewStyle().Foreground(lipgloss.Color("#6C6C6C")).Italic(true)
+	syntaxNumber     = lipgloss.NewStyle().Foreground(lipgloss.Color("#5FD7D7"))
+	diagMessageStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("#D0D0D0"))
+)
+
+// diffCache holds the rendered diff of each file until its original, its
+// content on disk or its diagnostics change, since the view is redrawn on
+// every update of the selected file.
+type diffCache map[string]diffEntry
+
+type diffEntry struct {
+	original string
+	modTime  time.Time
+	size     int64
+	marks    string
+	rendered string
+}
+
+// renderDiff shows a unified diff between the original and the current
+// content of the file, marking lines that carry diagnostics in the gutter.
+func renderDiff(f *types.FileProcess, cache diffCache) string {
+	f.Mutex.Lock()
+	original := f.Original
+	diags := f.Diagnostics
+	f.Mutex.Unlock()
+
+	if original == "" {
+		return "Original content not recorded yet"
+	}
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return fmt.Sprintf("Cannot read %s: %v", f.Path, err)
+	}
+	marked := make(map[int]bool)
+	var marks strings.Builder
+	for _, d := range diags {
+		marked[d.Line] = true
+		fmt.Fprintf(&marks, "%d,", d.Line)
+	}
+	entry := diffEntry{original: original, modTime: info.ModTime(), size: info.Size(), marks: marks.String()}
+	if cached, ok := cache[f.Path]; ok && cached.modTime.Equal(entry.modTime) && cached.size == entry.size &&
+		cached.marks == entry.marks && cached.original == entry.original {
+		return cached.rendered
+	}
+
+	current, err := os.ReadFile(f.Path)
+	if err != nil {
+		return fmt.Sprintf("Cannot read %s: %v", f.Path, err)
+	}
+	entry.rendered = diffLines(original, string(current), marked)
+	cache[f.Path] = entry
+	return entry.rendered
+}
+
+func diffLines(original, current string, marked map[int]bool) string {
+	hunks := diff.Hunks(diff.Lines(diff.SplitLines(original), diff.SplitLines(current)), 3)
+	if len(hunks) == 0 {
+		return "No changes"
+	}
+
+	var lines []string
+	for _, h := range hunks {
+		lines = append(lines, diffHunkStyle.Render(h.Header()))
+		for _, op := range h.Ops {
+			lines = append(lines, renderDiffLine(op, marked[op.NewLine] && op.Kind != diff.Delete))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func renderDiffLine(op diff.Op, marked bool) string {
+	lineNo := func(n int) string {
+		if n == 0 {
+			return "    "
+		}
+		return fmt.Sprintf("%4d", n)
+	}
+	marker := " "
+	if marked {
+		marker = diagMarkerStyle.Render("●")
+	}
+	gutter := diffGutterStyle.Render(lineNo(op.OldLine)+" "+lineNo(op.NewLine)) + " " + marker + " "
+
+	switch op.Kind {
+	case diff.Insert:
+		return gutter + diffAddStyle.Render("+") + highlightGo(op.Text)
+	case diff.Delete:
+		return gutter + diffDelStyle.Render("-"+op.Text)
+	default:
+		return gutter + " " + highlightGo(op.Text)
+	}
+}
+
+func renderDiagnostics(f *types.FileProcess) string {
+	f.Mutex.Lock()
+	diags := f.Diagnostics
+	f.Mutex.Unlock()
+
+	if len(diags) == 0 {
+		return "No diagnostics"
+	}
+
+	content, _ := os.ReadFile(f.Path)
+	source := diff.SplitLines(string(content))
+
+	var lines []string
+	for _, d := range diags {
+		pos := fmt.Sprintf("%d:%d", d.Line, d.Column)
+		msg := d.Message
+		if d.Linter != "" {
+			msg += " (" + d.Linter + ")"
+		}
+		lines = append(lines, diagMarkerStyle.Render("● "+pos)+" "+diagMessageStyle.Render(msg))
+		if d.Line > 0 && d.Line <= len(source) {
+			lines = append(lines, diffGutterStyle.Render(fmt.Sprintf("%6d │ ", d.Line))+highlightGo(source[d.Line-1]))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// highlightGo colours a single line of Go source. Lines inside multi-line
+// comments or raw strings are tokenized on their own and may be coloured
+// approximately.
+func highlightGo(line string) string {
+	fset := token.NewFileSet()
+	file := fset.AddFile("", fset.Base(), len(line))
+	var s scanner.Scanner
+	s.Init(file, []byte(line), func(token.Position, string) {}, scanner.ScanComments)
+
+	var sb strings.Builder
+	last := 0
+	for {
+		pos, tok, lit := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+		start := file.Offset(pos)
+		if start < last || start > len(line) {
+			continue
+		}
+		text := lit
+		if tok.IsOperator() || tok.IsKeyword() || lit == "" {
+			text = tok.String()
+		}
+		end := min(start+len(text), len(line))
+		if line[start:end] != text {
+			// Automatically inserted semicolons have no source text.
+			continue
+		}
+		sb.WriteString(line[last:start])
+		switch {
+		case tok.IsKeyword():
+			sb.WriteString(syntaxKeyword.Render(text))
+		case tok == token.STRING || tok == token.CHAR:
+			sb.WriteString(syntaxString.Render(text))
+		case tok == token.COMMENT:
+			sb.WriteString(syntaxComment.Render(text))
+		case tok == token.INT || tok == token.FLOAT || tok == token.IMAG:
+			sb.WriteString(syntaxNumber.Render(text))
+		default:
+			sb.WriteString(text)
+		}
+		last = end
+	}
+	sb.WriteString(line[last:])
+	return sb.String()
+}
@@ -0,0 +1,91 @@
+package tui
+
+import (
+	"strings"
+)
+
+type statusFilter int
+
+const (
+	filterAll statusFilter = iota
+	filterFailed
+	filterInProgress
+	filterHideFixed
+)
+
+func (f statusFilter) String() string {
+	switch f {
+	case filterFailed:
+		return "failed"
+	case filterInProgress:
+		return "in progress"
+	case filterHideFixed:
+		return "hide fixed"
+	default:
+		return "all"
+	}
+}
+
+func (f statusFilter) next() statusFilter {
+	return (f + 1) % 4
+}
+
+func (f statusFilter) match(status string) bool {
+	switch f {
+	case filterFailed:
+		return status == "Failed" || status == "Conflict"
+	case filterInProgress:
+		return status != "Pending" && status != "Fixed" && status != "Failed" && status != "Conflict" && status != "Skipped"
+	case filterHideFixed:
+		return status != "Fixed"
+	default:
+		return true
+	}
+}
+
+// fuzzyMatch reports whether all runes of query appear in s in order,
+// ignoring case.
+func fuzzyMatch(s, query string) bool {
+	s = strings.ToLower(s)
+	for _, r := range strings.ToLower(query) {
+		i := strings.IndexRune(s, r)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(string(r)):]
+	}
+	return true
+}
+
+type rowFilter struct {
+	query  string
+	status statusFilter
+}
+
+func (f rowFilter) active() bool {
+	return f.query != "" || f.status != filterAll
+}
+
+func (f rowFilter) match(n *treeNode) bool {
+	return f.status.match(n.file.Status) && fuzzyMatch(n.file.Path, f.query)
+}
+
+// filtered flattens the tree keeping only files accepted by the filter and
+// the directories leading to them. Directories are shown expanded while a
+// filter is active so that every match is visible.
+func (n *treeNode) filtered(f rowFilter) []*treeNode {
+	var out []*treeNode
+	for _, c := range n.children {
+		if !c.isDir() {
+			if f.match(c) {
+				out = append(out, c)
+			}
+			continue
+		}
+		if sub := c.filtered(f); len(sub) > 0 {
+			out = append(out, c)
+			out = append(out, sub...)
+		}
+	}
+	return out
+}
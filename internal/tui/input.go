@@ -3,6 +3,9 @@ package tui
 import tea "github.com/charmbracelet/bubbletea"
 
 func (m *model) handleKeys(msg tea.KeyMsg) tea.Cmd {
+	if m.filtering {
+		return m.handleFilterKeys(msg)
+	}
 	if m.logFocused {
 		switch msg.String() {
 		case "q", "esc":
@@ -19,6 +22,10 @@ func (m *model) handleKeys(msg tea.KeyMsg) tea.Cmd {
 			m.logView.GotoTop()
 		case "G":
 			m.logView.GotoBottom()
+		case "v":
+			m.viewMode = m.viewMode.next()
+			m.updateLogView()
+			m.logView.GotoTop()
 		}
 	} else {
 		switch msg.String() {
@@ -26,22 +33,93 @@ func (m *model) handleKeys(msg tea.KeyMsg) tea.Cmd {
 			m.quitting = true
 			return tea.Quit
 		case "up", "k":
-			if m.table.cursor > 0 {
-				m.table.cursor--
-			}
+			m.table.moveCursor(-1)
 			m.updateLogView()
 		case "down", "j":
-			if m.table.cursor < len(m.table.rows)-1 {
-				m.table.cursor++
-			}
+			m.table.moveCursor(1)
+			m.updateLogView()
+		case "pgup":
+			m.table.moveCursor(-m.table.pageSize())
+			m.updateLogView()
+		case "pgdown":
+			m.table.moveCursor(m.table.pageSize())
+			m.updateLogView()
+		case "home", "g":
+			m.table.moveCursor(-len(m.table.rows))
+			m.updateLogView()
+		case "end", "G":
+			m.table.moveCursor(len(m.table.rows))
+			m.updateLogView()
+		case "left", "h":
+			m.table.setExpanded(false)
+			m.updateLogView()
+		case "right", "l":
+			m.table.setExpanded(true)
 			m.updateLogView()
+		case " ":
+			if node := m.table.selected(); node != nil && node.isDir() {
+				m.table.setExpanded(!node.expanded)
+			}
 		case "enter":
+			if node := m.table.selected(); node != nil && node.isDir() {
+				m.table.setExpanded(!node.expanded)
+				return nil
+			}
 			m.logFocused = true
+		case "v", "V":
+			m.viewMode = m.viewMode.next()
+			m.updateLogView()
+			m.logView.GotoTop()
+		case "/":
+			m.filtering = true
+			m.filterInput.SetValue(m.table.filter.query)
+			m.filterInput.CursorEnd()
+			return m.filterInput.Focus()
+		case "y", "Y":
+			if node := m.table.selected(); node != nil && !node.isDir() && m.confirm != nil {
+				node.file.Mutex.Lock()
+				waiting := node.file.Status == "Needs confirmation"
+				node.file.Mutex.Unlock()
+				if waiting {
+					m.confirm(node.file.Path)
+				}
+			}
+		case "f", "F":
+			m.table.filter.status = m.table.filter.status.next()
+			m.table.refresh()
+			m.updateLogView()
+		case "esc":
+			m.table.filter = rowFilter{}
+			m.table.refresh()
+			m.updateLogView()
 		}
 	}
 	return nil
 }
 
+func (m *model) handleFilterKeys(msg tea.KeyMsg) tea.Cmd {
+	switch msg.String() {
+	case "enter":
+		m.filtering = false
+		m.filterInput.Blur()
+		return nil
+	case "esc":
+		m.filtering = false
+		m.filterInput.Blur()
+		m.filterInput.SetValue("")
+	case "ctrl+c":
+		m.quitting = true
+		return tea.Quit
+	}
+
+	var cmd tea.Cmd
+	m.filterInput, cmd = m.filterInput.Update(msg)
+	m.table.filter.query = m.filterInput.Value()
+	m.table.refresh()
+	m.updateLogView()
+	return cmd
+}
+
 func (m *model) handleMouse(msg tea.MouseMsg) tea.Cmd {
 	var cmd tea.Cmd
 	if m.logFocused {
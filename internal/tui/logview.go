@@ -2,7 +2,6 @@ package tui
 
 import (
 	"fmt"
-	"path/filepath"
 	"strings"
 
 	"github.com/charmbracelet/lipgloss"
@@ -23,41 +22,48 @@ func (m model) renderLogView() string {
 
 func (m model) logHeaderView() string {
 	var title string
-	if m.table.cursor >= 0 && m.table.cursor < len(m.items) {
-		item := m.items[m.table.cursor]
-		if item.Type == "file" {
-			cmdName := strings.ReplaceAll(m.lintCmd, "{{filepath}}", filepath.Base(item.Path))
-			title = cmdName
+	if node := m.table.selected(); node != nil && !node.isDir() {
+		title = m.titles[node.path]
+		if title == "" && m.title != nil {
+			title = m.title(node.path)
+			m.titles[node.path] = title
 		}
 	}
 	if title == "" {
 		title = "No file selected"
 	}
-	return logHeaderStyle.Render("📄 " + title)
+	return logHeaderStyle.Render(fmt.Sprintf("📄 %s [%s]", title, m.viewMode))
 }
 
 func (m model) logFooterView() string {
 	info := fmt.Sprintf(" %3.f%% ", m.logView.ScrollPercent()*100)
 	if m.logFocused {
-		info += " ↑/↓: scroll • ESC: back "
+		info += " ↑/↓: scroll • v: view • ESC: back "
 	}
 	return logFooterStyle.Render(info)
 }
 
 func (m *model) updateLogView() {
-	if m.table.cursor >= 0 && m.table.cursor < len(m.items) {
-		item := m.items[m.table.cursor]
-		if item.Type == "file" {
-			var lines []string
-			for i, log := range item.File.Logs {
-				lines = append(lines, fmt.Sprintf("%4d │ %s", i+1, log))
-			}
-			content := strings.Join(lines, "\n")
-			m.logView.SetContent(content)
-
-			if m.logView.AtBottom() {
-				m.logView.GotoBottom()
-			}
+	node := m.table.selected()
+	if node == nil || node.isDir() {
+		return
+	}
+	var content string
+	switch m.viewMode {
+	case diffMode:
+		content = renderDiff(node.file, m.diffs)
+	case diagnosticsMode:
+		content = renderDiagnostics(node.file)
+	default:
+		var lines []string
+		for i, log := range node.file.Logs {
+			lines = append(lines, fmt.Sprintf("%4d │ %s", i+1, log))
 		}
+		content = strings.Join(lines, "\n")
+	}
+	m.logView.SetContent(content)
+
+	if m.logView.AtBottom() {
+		m.logView.GotoBottom()
 	}
 }
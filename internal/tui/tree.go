@@ -0,0 +1,297 @@
+package tui
+
+import (
+	"deeprefactor/internal/types"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type treeNode struct {
+	name     string
+	path     string
+	file     *types.FileProcess
+	parent   *treeNode
+	children []*treeNode
+	expanded bool
+	depth    int
+}
+
+type treeCounts struct {
+	fixed   int
+	failed  int
+	skipped int
+	pending int
+	total   int
+	usage   types.Usage
+}
+
+func buildTree(files []*types.FileProcess) *treeNode {
+	root := &treeNode{expanded: true, depth: -1}
+	dirs := map[string]*treeNode{".": root}
+
+	var dirFor func(dir string) *treeNode
+	dirFor = func(dir string) *treeNode {
+		if node, ok := dirs[dir]; ok {
+			return node
+		}
+		if filepath.Dir(dir) == dir {
+			// Filesystem root of an absolute path.
+			return root
+		}
+		parent := dirFor(filepath.Dir(dir))
+		node := &treeNode{
+			name:     filepath.Base(dir) + string(filepath.Separator),
+			path:     dir,
+			parent:   parent,
+			expanded: true,
+			depth:    parent.depth + 1,
+		}
+		parent.children = append(parent.children, node)
+		dirs[dir] = node
+		return node
+	}
+
+	for _, f := range files {
+		parent := dirFor(filepath.Clean(filepath.Dir(f.Path)))
+		parent.children = append(parent.children, &treeNode{
+			name:   filepath.Base(f.Path),
+			path:   f.Path,
+			file:   f,
+			parent: parent,
+			depth:  parent.depth + 1,
+		})
+	}
+
+	root.compact()
+	root.sort()
+	return root
+}
+
+// compact merges chains of directories that only contain a single
+// subdirectory, so deep paths take one row instead of many.
+func (n *treeNode) compact() {
+	for i, c := range n.children {
+		for c.isDir() && len(c.children) == 1 && c.children[0].isDir() {
+			only := c.children[0]
+			only.name = c.name + only.name
+			only.parent = n
+			c = only
+		}
+		c.reindent(n.depth + 1)
+		n.children[i] = c
+		c.compact()
+	}
+}
+
+func (n *treeNode) reindent(depth int) {
+	n.depth = depth
+	for _, c := range n.children {
+		c.reindent(depth + 1)
+	}
+}
+
+// sort orders directories before files, each alphabetically.
+func (n *treeNode) sort() {
+	sort.SliceStable(n.children, func(i, j int) bool {
+		a, b := n.children[i], n.children[j]
+		if a.isDir() != b.isDir() {
+			return a.isDir()
+		}
+		return a.name < b.name
+	})
+	for _, c := range n.children {
+		c.sort()
+	}
+}
+
+func (n *treeNode) isDir() bool {
+	return n.file == nil
+}
+
+// visible flattens the expanded part of the tree in display order.
+func (n *treeNode) visible() []*treeNode {
+	var out []*treeNode
+	for _, c := range n.children {
+		out = append(out, c)
+		if c.isDir() && c.expanded {
+			out = append(out, c.visible()...)
+		}
+	}
+	return out
+}
+
+func (n *treeNode) counts() treeCounts {
+	var c treeCounts
+	if !n.isDir() {
+		c.total = 1
+		c.usage = n.file.Usage
+		switch n.file.Status {
+		case "Fixed":
+			c.fixed = 1
+		case "Failed", "Conflict":
+			c.failed = 1
+		case "Skipped":
+			c.skipped = 1
+		default:
+			c.pending = 1
+		}
+		return c
+	}
+	for _, child := range n.children {
+		cc := child.counts()
+		c.fixed += cc.fixed
+		c.failed += cc.failed
+		c.skipped += cc.skipped
+		c.pending += cc.pending
+		c.total += cc.total
+		c.usage.Add(cc.usage)
+	}
+	return c
+}
+
+func (c treeCounts) done() int {
+	return c.fixed + c.failed + c.skipped
+}
+
+func (c treeCounts) String() string {
+	s := fmt.Sprintf("✓%d ✗%d …%d", c.fixed, c.failed, c.pending)
+	if c.skipped > 0 {
+		s += fmt.Sprintf(" ⊘%d", c.skipped)
+	}
+	return s
+}
+
+func renderProgressBar(done, total, width int) string {
+	if width <= 0 {
+		return ""
+	}
+	filled := 0
+	if total > 0 {
+		filled = done * width / total
+	}
+	return strings.Repeat("█", filled) + strings.Repeat("░", width-filled)
+}
+
+func (t *tableModel) visibleRows() []*treeNode {
+	if t.filter.active() {
+		return t.root.filtered(t.filter)
+	}
+	return t.root.visible()
+}
+
+func (t *tableModel) pageSize() int {
+	// One line is taken by the column header.
+	return max(t.maxHeight-1, 1)
+}
+
+func (t *tableModel) selected() *treeNode {
+	if t.cursor >= 0 && t.cursor < len(t.rows) {
+		return t.rows[t.cursor]
+	}
+	return nil
+}
+
+func (t *tableModel) moveCursor(delta int) {
+	t.cursor = max(0, min(t.cursor+delta, len(t.rows)-1))
+	t.scrollToCursor()
+}
+
+func (t *tableModel) scrollToCursor() {
+	page := t.pageSize()
+	if t.cursor < t.offset {
+		t.offset = t.cursor
+	}
+	if t.cursor >= t.offset+page {
+		t.offset = t.cursor - page + 1
+	}
+	t.offset = max(0, min(t.offset, len(t.rows)-page))
+}
+
+// refresh rebuilds the visible rows and keeps the cursor on the same node.
+func (t *tableModel) refresh() {
+	current := t.selected()
+	t.rows = t.visibleRows()
+	t.cursor = 0
+	for i, n := range t.rows {
+		if n == current {
+			t.cursor = i
+			break
+		}
+	}
+	t.scrollToCursor()
+}
+
+func (t *tableModel) setExpanded(expanded bool) {
+	node := t.selected()
+	if node == nil || t.filter.active() {
+		return
+	}
+	if !node.isDir() || node.expanded == expanded {
+		if !expanded && node.parent != nil && node.parent != t.root {
+			// Collapsing a file or an already collapsed directory jumps to its parent.
+			node = node.parent
+			node.expanded = false
+			t.rows = t.visibleRows()
+			for i, n := range t.rows {
+				if n == node {
+					t.cursor = i
+				}
+			}
+			t.scrollToCursor()
+		}
+		return
+	}
+	node.expanded = expanded
+	t.refresh()
+}
+
+// addFile adds a file found after the UI started and rebuilds the tree,
+// keeping collapsed directories collapsed and the same row selected.
+func (m *model) addFile(f *types.FileProcess) {
+	m.items = append(m.items, types.TableItem{Type: "file", Path: filepath.Base(f.Path), File: f, Indent: 2})
+	var files []*types.FileProcess
+	for _, item := range m.items {
+		if item.Type == "file" {
+			files = append(files, item.File)
+		}
+	}
+
+	collapsed := make(map[string]bool)
+	m.table.root.each(func(n *treeNode) {
+		if n.isDir() && !n.expanded {
+			collapsed[n.path] = true
+		}
+	})
+	selected := ""
+	if n := m.table.selected(); n != nil {
+		selected = n.path
+	}
+
+	root := buildTree(files)
+	root.each(func(n *treeNode) {
+		if collapsed[n.path] {
+			n.expanded = false
+		}
+	})
+	m.table.root = root
+	m.table.totalItems = len(files)
+	m.table.rows = m.table.visibleRows()
+	m.table.cursor = 0
+	for i, n := range m.table.rows {
+		if n.path == selected {
+			m.table.cursor = i
+			break
+		}
+	}
+	m.table.scrollToCursor()
+}
+
+// each calls fn for every node below n.
+func (n *treeNode) each(fn func(*treeNode)) {
+	for _, c := range n.children {
+		fn(c)
+		c.each(fn)
+	}
+}
@@ -0,0 +1,42 @@
+package tui
+
+import (
+	"deeprefactor/internal/types"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuildTreeAbsolutePaths(t *testing.T) {
+	dir, err := filepath.Abs(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := []*types.FileProcess{
+		{Path: filepath.Join(dir, "a.go")},
+		{Path: filepath.Join(dir, "sub", "b.go")},
+	}
+
+	root := buildTree(files)
+	if len(root.children) != 1 {
+		t.Fatalf("root has %d children, want the served directory only", len(root.children))
+	}
+	top := root.children[0]
+	if top.path != dir || top.depth != 0 {
+		t.Errorf("top directory = %q at depth %d, want %q at depth 0", top.path, top.depth, dir)
+	}
+
+	var found []string
+	var walk func(n *treeNode)
+	walk = func(n *treeNode) {
+		if n.file != nil {
+			found = append(found, n.path)
+		}
+		for _, c := range n.children {
+			walk(c)
+		}
+	}
+	walk(root)
+	if len(found) != len(files) {
+		t.Errorf("tree holds %v, want %d files", found, len(files))
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/charmbracelet/bubbles/textinput"
 	"github.com/charmbracelet/bubbles/viewport"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
@@ -67,24 +68,42 @@ type model struct {
 	width         int
 	height        int
 	logFocused    bool
-	lastUpdate    sync.Mutex
+	lastUpdate    *sync.Mutex
 	statusMessage string
-	lintCmd       string
+	filterInput   textinput.Model
+	filtering     bool
+	viewMode      viewMode
+	diffs         diffCache
+	// title gives the log header of a file, and titles caches it.
+	title  func(path string) string
+	titles map[string]string
+	// maxRetries is the number of attempts each file gets.
+	maxRetries int
+	// confirm is called with the selected file when the user confirms a
+	// fix, or is nil when nothing asks for confirmation.
+	confirm func(path string)
 }
 
 type tableModel struct {
 	columns    []string
-	rows       []types.Row
+	root       *treeNode
+	rows       []*treeNode
 	cursor     int
+	offset     int
 	maxWidth   int
 	maxHeight  int
 	totalItems int
+	filter     rowFilter
 }
 
-func Create(files []*types.FileProcess, processFunc func(updates chan<- types.FileUpdate, items []types.TableItem), lintCmd string) error {
+// Create runs the UI until the user quits. Files with the status "Needs
+// confirmation" are passed to confirm when the user presses y.
+func Create(files []*types.FileProcess, processFunc func(updates chan<- types.FileUpdate, items []types.TableItem), title func(path string) string, maxRetries int, confirm func(path string)) error {
 	m := InitialModel(files)
 	m.updateChan = make(chan types.FileUpdate, 100)
-	m.lintCmd = lintCmd
+	m.title = title
+	m.maxRetries = maxRetries
+	m.confirm = confirm
 	processFunc(m.updateChan, m.items)
 	p := tea.NewProgram(m, tea.WithAltScreen(), tea.WithMouseCellMotion())
 	if _, err := p.Run(); err != nil {
@@ -124,36 +143,32 @@ func InitialModel(files []*types.FileProcess) model {
 		}
 	}
 
-	columns := []string{"Path", "Status", "Attempts"}
-	var rows []types.Row
-	for _, item := range items {
-		var status, attempts string
-		if item.Type == "file" {
-			status = item.File.Status
-			attempts = fmt.Sprintf("%d/%d", item.File.Retries, 5)
-		}
-
-		rows = append(rows, types.Row{
-			Key:  item.Path,
-			Data: []string{item.Path, status, attempts},
-		})
-	}
+	root := buildTree(files)
 
 	vp := viewport.New(0, 0)
 	vp.MouseWheelEnabled = true
 	vp.Style = tableBorderStyle
 
+	fi := textinput.New()
+	fi.Prompt = "/"
+	fi.Placeholder = "filter files"
+
 	return model{
 		items: items,
 		table: tableModel{
-			columns:    columns,
-			rows:       rows,
+			columns:    []string{"Path", "Status", "Attempts", "Tokens", "Time"},
+			root:       root,
+			rows:       root.visible(),
 			maxWidth:   60,
 			maxHeight:  20,
-			totalItems: len(items),
+			totalItems: len(files),
 		},
-		logView:    vp,
-		updateChan: make(chan types.FileUpdate, 100),
+		logView:     vp,
+		updateChan:  make(chan types.FileUpdate, 100),
+		lastUpdate:  &sync.Mutex{},
+		filterInput: fi,
+		diffs:       make(diffCache),
+		titles:      make(map[string]string),
 	}
 }
 
@@ -208,6 +223,7 @@ func (m *model) handleResize(msg tea.WindowSizeMsg) {
 	m.logView.Width = logWidth
 	m.logView.Height = logHeight
 	m.logView.YPosition = headerHeight + 1
+	m.table.scrollToCursor()
 	m.updateLogView()
 }
 
@@ -215,28 +231,25 @@ func (m *model) handleFileUpdate(update types.FileUpdate) {
 	m.lastUpdate.Lock()
 	defer m.lastUpdate.Unlock()
 
-	for i, item := range m.items {
+	found := false
+	for _, item := range m.items {
 		if item.Type == "file" && item.File.Path == update.Path {
 			item.File.Mutex.Lock()
-			if update.Status != "" {
-				item.File.Status = update.Status
-			}
-			if update.Log != "" {
-				item.File.Logs = append(item.File.Logs, update.Log)
-			}
-			if strings.Contains(update.Status, "Attempt") {
-				item.File.Retries++
-			}
+			item.File.Apply(update)
 			item.File.Mutex.Unlock()
-
-			m.table.rows[i].Data = []string{
-				strings.Repeat(" ", item.Indent) + filepath.Base(item.File.Path),
-				item.File.Status,
-				fmt.Sprintf("%d/%d", item.File.Retries, 5),
-			}
+			found = true
 			break
 		}
 	}
+	if !found && update.File != nil {
+		update.File.Mutex.Lock()
+		update.File.Apply(update)
+		update.File.Mutex.Unlock()
+		m.addFile(update.File)
+	}
+	if m.table.filter.active() {
+		m.table.refresh()
+	}
 	m.updateLogView()
 }
 
@@ -255,11 +268,17 @@ func (m model) View() string {
 		logView,
 	)
 
+	counts := m.table.root.counts()
 	statusBar := statusBarStyle.Render(fmt.Sprintf(
-		" %d items | %s | %s ",
+		" %d files | %s %d/%d | %s tokens, %s | %s | %s ",
 		m.table.totalItems,
+		renderProgressBar(counts.done(), counts.total, 20),
+		counts.done(),
+		counts.total,
+		formatTokens(counts.usage),
+		formatDuration(counts.usage),
 		m.getStatusMessage(),
-		"↑/↓: Navigate • Enter: Logs • Q: Quit",
+		m.getHelpMessage(),
 	))
 
 	return lipgloss.Place(
@@ -287,12 +306,8 @@ func (m model) renderTable() string {
 
 func (m model) renderTableHeader() string {
 	var headers []string
-	for i, col := range m.table.columns {
-		width := 10
-		if i == 0 {
-			width = m.table.maxWidth - 40
-		}
-		header := tableHeaderStyle.Width(width).Render(col)
+	for _, col := range m.table.columns {
+		header := tableHeaderStyle.Width(m.table.columnWidth(col)).Render(col)
 		headers = append(headers, header)
 	}
 	return lipgloss.JoinHorizontal(lipgloss.Left, headers...)
@@ -300,40 +315,111 @@ func (m model) renderTableHeader() string {
 
 func (m model) renderTableRows() string {
 	var renderedRows []string
-	for i, row := range m.table.rows {
-		item := m.items[i]
-		var cells []string
+	end := min(m.table.offset+m.table.pageSize(), len(m.table.rows))
+	for i := m.table.offset; i < end; i++ {
+		node := m.table.rows[i]
+		style := tableFileStyle
+		if node.isDir() {
+			style = tableDirectoryStyle
+		}
+		if i == m.table.cursor {
+			style = tableSelectedStyle
+		}
 
-		for j, d := range row.Data {
-			style := tableFileStyle
-			if item.Type == "directory" {
-				style = tableDirectoryStyle
-			}
-			if i == m.table.cursor {
-				style = tableSelectedStyle
-			}
-
-			// Apply different width constraints
-			switch m.table.columns[j] {
-			case "Path":
-				cells = append(cells, style.Width(m.table.maxWidth-40).Render(d))
-			case "Status":
-				cells = append(cells, style.Width(18).Render(d))
-			case "Attempts":
-				cells = append(cells, style.Width(10).Render(d))
-			}
+		data := rowData(node, m.maxRetries)
+		var cells []string
+		for j, d := range data {
+			width := m.table.columnWidth(m.table.columns[j])
+			cells = append(cells, style.Width(width).MaxHeight(1).Render(d))
 		}
 		renderedRows = append(renderedRows, lipgloss.JoinHorizontal(lipgloss.Left, cells...))
 	}
 	return strings.Join(renderedRows, "\n")
 }
 
+// columnWidth applies different width constraints per column.
+func (t tableModel) columnWidth(col string) int {
+	switch col {
+	case "Path":
+		return max(t.maxWidth-56, 16)
+	case "Status":
+		return 18
+	case "Tokens", "Time":
+		return 9
+	default:
+		return 10
+	}
+}
+
+func rowData(node *treeNode, maxRetries int) []string {
+	indent := strings.Repeat("  ", node.depth)
+	if node.isDir() {
+		marker := "▸ "
+		if node.expanded {
+			marker = "▾ "
+		}
+		c := node.counts()
+		return []string{
+			indent + marker + node.name,
+			c.String(),
+			renderProgressBar(c.done(), c.total, 8),
+			formatTokens(c.usage),
+			formatDuration(c.usage),
+		}
+	}
+	return []string{
+		indent + "  " + node.name,
+		node.file.Status,
+		fmt.Sprintf("%d/%d", node.file.Retries, maxRetries),
+		formatTokens(node.file.Usage),
+		formatDuration(node.file.Usage),
+	}
+}
+
+func formatTokens(u types.Usage) string {
+	if u.Requests == 0 {
+		return "-"
+	}
+	if u.Tokens() >= 10000 {
+		return fmt.Sprintf("%.1fk", float64(u.Tokens())/1000)
+	}
+	return fmt.Sprintf("%d", u.Tokens())
+}
+
+func formatDuration(u types.Usage) string {
+	if u.Requests == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1fs", u.Duration.Seconds())
+}
+
 func (m *model) getStatusMessage() string {
 	if m.statusMessage != "" {
 		return m.statusMessage
 	}
+	if m.filtering {
+		return m.filterInput.View()
+	}
+	if f := m.table.filter; f.active() {
+		msg := "filter: " + f.status.String()
+		if f.query != "" {
+			msg += " /" + f.query
+		}
+		return fmt.Sprintf("%s (%d rows)", msg, len(m.table.rows))
+	}
 	if len(m.items) == 0 {
 		return "No files processed"
 	}
 	return "OK"
 }
+
+func (m *model) getHelpMessage() string {
+	if m.filtering {
+		return "Enter: Apply • Esc: Clear"
+	}
+	help := "↑/↓: Navigate • ←/→: Collapse/Expand • /: Search • F: Status filter • V: Log/Diff/Diagnostics • Enter: Logs • Q: Quit"
+	if m.confirm != nil {
+		help = "Y: Fix • " + help
+	}
+	return help
+}
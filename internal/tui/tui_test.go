@@ -0,0 +1,13 @@
+package tui
+
+import (
+	"deeprefactor/internal/types"
+	"testing"
+)
+
+func TestRowDataAttempts(t *testing.T) {
+	node := &treeNode{name: "a.go", path: "a.go", file: &types.FileProcess{Path: "a.go", Status: "Attempt 2/3", Retries: 2}}
+	if got := rowData(node, 3)[2]; got != "2/3" {
+		t.Errorf("attempts = %q, want 2/3", got)
+	}
+}
@@ -1,27 +1,109 @@
 package types
 
 import (
+	"fmt"
+	"strings"
 	"sync"
+	"time"
 )
 
 type FileProcess struct {
-	Path     string
-	Status   string
-	Logs     []string
-	Retries  int
-	Selected bool
-	Mutex    sync.Mutex
+	Path        string
+	Status      string
+	Logs        []string
+	Retries     int
+	Selected    bool
+	Original    string
+	Diagnostics []Diagnostic
+	Usage       Usage
+	Mutex       sync.Mutex
 }
 
+// FileUpdate is an event in the processing of a file. The JSON form is
+// streamed by the serve command.
 type FileUpdate struct {
-	Path   string
-	Status string
-	Log    string
+	Path   string `json:"path"`
+	Status string `json:"status,omitempty"`
+	Log    string `json:"log,omitempty"`
+	// Diagnostics replaces the file's diagnostics when non-nil. An empty
+	// slice clears them.
+	Diagnostics []Diagnostic `json:"diagnostics"`
+	// Usage is added to the file's running totals.
+	Usage Usage `json:"usage"`
+	// File introduces a file the receiver does not know yet, for commands
+	// such as watch that find their files as they go.
+	File *FileProcess `json:"-"`
+}
+
+// Apply records an update. Statuses containing "Attempt" count as a retry.
+// The caller must hold the mutex.
+func (f *FileProcess) Apply(update FileUpdate) {
+	if update.Status != "" {
+		f.Status = update.Status
+	}
+	if update.Log != "" {
+		f.Logs = append(f.Logs, update.Log)
+	}
+	if strings.Contains(update.Status, "Attempt") {
+		f.Retries++
+	}
+	if update.Diagnostics != nil {
+		f.Diagnostics = update.Diagnostics
+	}
+	f.Usage.Add(update.Usage)
+}
+
+// Usage records model consumption for one or more requests.
+type Usage struct {
+	Requests         int           `json:"requests"`
+	PromptTokens     int           `json:"prompt_tokens"`
+	CompletionTokens int           `json:"completion_tokens"`
+	Duration         time.Duration `json:"duration_ns"`
+}
+
+func (u *Usage) Add(o Usage) {
+	u.Requests += o.Requests
+	u.PromptTokens += o.PromptTokens
+	u.CompletionTokens += o.CompletionTokens
+	u.Duration += o.Duration
+}
+
+func (u Usage) Tokens() int {
+	return u.PromptTokens + u.CompletionTokens
+}
+
+type Diagnostic struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Message string `json:"message"`
+	Linter  string `json:"linter,omitempty"`
+	// Fixes holds machine-applicable fixes reported with the diagnostic,
+	// if the checker provides them.
+	Fixes []SuggestedFix `json:"fixes,omitempty"`
+}
+
+// SuggestedFix is a set of edits that resolves a diagnostic.
+type SuggestedFix struct {
+	Message string     `json:"message"`
+	Edits   []TextEdit `json:"edits"`
+}
+
+// TextEdit replaces the bytes [Start, End) of File with NewText.
+type TextEdit struct {
+	File    string `json:"file"`
+	Start   int    `json:"start"`
+	End     int    `json:"end"`
+	NewText string `json:"new_text"`
 }
 
-type Row struct {
-	Key  string
-	Data []string
+// String formats the diagnostic the way linters print it.
+func (d Diagnostic) String() string {
+	s := fmt.Sprintf("%s:%d:%d: %s", d.File, d.Line, d.Column, d.Message)
+	if d.Linter != "" {
+		s += " (" + d.Linter + ")"
+	}
+	return s
 }
 
 type TableItem struct {
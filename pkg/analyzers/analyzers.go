@@ -0,0 +1,28 @@
+// Package analyzers lets a custom build of DeepRefactor run team-specific
+// go/analysis analyzers. Register them from an init function in a package
+// imported by your main package:
+//
+//	func init() {
+//		analyzers.Register(bannedapi.Analyzer, "Replace calls to banned APIs with the approved wrapper.")
+//	}
+//
+// Registered analyzers form the "custom" suite, which the analysis checker
+// runs by default alongside the vet suite.
+package analyzers
+
+import (
+	"deeprefactor/internal/driver"
+
+	"golang.org/x/tools/go/analysis"
+)
+
+// Register adds a to the "custom" suite. The hint, if not empty, is sent to
+// the model with the analyzer's findings to explain how to fix them.
+func Register(a *analysis.Analyzer, hint string) {
+	driver.Register(a, hint)
+}
+
+// Names lists the analyzers and suites that can be selected.
+func Names() []string {
+	return driver.Names()
+}
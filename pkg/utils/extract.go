@@ -0,0 +1,196 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"slices"
+	"strings"
+)
+
+// Candidate is a block of code found in a model response.
+type Candidate struct {
+	// Lang is the fence label, such as "go", or "" for an unlabelled fence
+	// or a response without fences.
+	Lang string
+	Code string
+	// Terminated is false for a fence left open by a truncated response.
+	Terminated bool
+	// Score ranks usable candidates; Problem explains why a candidate was
+	// rejected and is empty for usable ones.
+	Score   int
+	Problem string
+}
+
+// Extraction is the result of ExtractGoCode.
+type Extraction struct {
+	// Code is the chosen source, ending in a newline.
+	Code string
+	// Candidates holds every block considered, in response order.
+	Candidates []Candidate
+	// Chosen indexes the candidate Code came from.
+	Chosen int
+}
+
+// ErrNoCode is wrapped by the errors of ExtractGoCode.
+var ErrNoCode = errors.New("no usable Go code in response")
+
+var goLangs = map[string]bool{"go": true, "golang": true}
+
+// ExtractGoCode picks the Go source file in a model response. Fenced blocks
+// opened with ``` or ~~~ are candidates whatever their label, including a
+// last fence that is never closed; a response without fences is one
+// candidate when it starts with a package clause. Candidates that are not
+// Go, do not parse as a complete file or declare a package other than one
+// of pkgs (unless no package is given) are rejected. Of the rest,
+// Go-labelled, complete and longer blocks are preferred, and later blocks
+// win ties since models tend to end with their final answer.
+func ExtractGoCode(response string, pkgs ...string) (Extraction, error) {
+	var want []string
+	for _, pkg := range pkgs {
+		if pkg != "" {
+			want = append(want, pkg)
+		}
+	}
+	candidates := findCandidates(response)
+	best := -1
+	for i := range candidates {
+		c := &candidates[i]
+		score(c, want)
+		if c.Problem == "" && (best < 0 || c.Score >= candidates[best].Score) {
+			best = i
+		}
+	}
+
+	result := Extraction{Candidates: candidates, Chosen: best}
+	if best < 0 {
+		if len(candidates) == 0 {
+			return result, fmt.Errorf("%w: the response contains no code block", ErrNoCode)
+		}
+		var reasons []string
+		for i, c := range candidates {
+			label := c.Lang
+			if label == "" {
+				label = "unlabelled"
+			}
+			reasons = append(reasons, fmt.Sprintf("block %d (%s): %s", i+1, label, c.Problem))
+		}
+		return result, fmt.Errorf("%w: %s", ErrNoCode, strings.Join(reasons, "; "))
+	}
+	result.Code = strings.TrimSpace(candidates[best].Code) + "\n"
+	return result, nil
+}
+
+// findCandidates splits response into fenced blocks.
+func findCandidates(response string) []Candidate {
+	lines := strings.Split(strings.ReplaceAll(response, "\r\n", "\n"), "\n")
+	var candidates []Candidate
+	var cur *Candidate
+	var fence string
+	var body []string
+
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if cur == nil {
+			if f := fenceOf(trimmed); f != "" {
+				fence = f
+				lang := strings.ToLower(strings.TrimSpace(strings.TrimLeft(trimmed, f[:1])))
+				if fields := strings.Fields(lang); len(fields) > 0 {
+					lang = fields[0]
+				}
+				cur = &Candidate{Lang: lang}
+				body = nil
+			}
+			continue
+		}
+		if strings.HasPrefix(trimmed, fence) && strings.Trim(trimmed, fence[:1]) == "" {
+			cur.Code = strings.Join(body, "\n")
+			cur.Terminated = true
+			candidates = append(candidates, *cur)
+			cur = nil
+			continue
+		}
+		body = append(body, line)
+	}
+	if cur != nil {
+		cur.Code = strings.Join(body, "\n")
+		candidates = append(candidates, *cur)
+	}
+
+	if len(candidates) == 0 && strings.HasPrefix(strings.TrimSpace(response), "package ") {
+		candidates = append(candidates, Candidate{Code: response, Terminated: true})
+	}
+	return candidates
+}
+
+// fenceOf returns the fence that opens line, such as "```", or "".
+func fenceOf(line string) string {
+	for _, mark := range []string{"`", "~"} {
+		n := len(line) - len(strings.TrimLeft(line, mark))
+		if n >= 3 {
+			return strings.Repeat(mark, n)
+		}
+	}
+	return ""
+}
+
+// score rates c and sets Problem when it cannot be used.
+func score(c *Candidate, pkgs []string) {
+	switch {
+	case goLangs[c.Lang]:
+		c.Score += 1000
+	case c.Lang != "":
+		c.Problem = fmt.Sprintf("labelled %s, not Go", c.Lang)
+		return
+	}
+	if strings.TrimSpace(c.Code) == "" {
+		c.Problem = "empty"
+		return
+	}
+
+	file, err := parser.ParseFile(token.NewFileSet(), "", c.Code, parser.SkipObjectResolution)
+	if err != nil {
+		if !c.Terminated {
+			c.Problem = "unterminated and does not parse, the response was probably truncated: " + firstLine(err.Error())
+		} else {
+			c.Problem = "does not parse: " + firstLine(err.Error())
+		}
+		return
+	}
+	if len(pkgs) > 0 && !slices.Contains(pkgs, file.Name.Name) {
+		c.Problem = fmt.Sprintf("declares package %s, want %s", file.Name.Name, strings.Join(pkgs, " or "))
+		return
+	}
+	if c.Terminated {
+		c.Score += 500
+	}
+	c.Score += min(strings.Count(c.Code, "\n"), 499)
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
+
+// Packages returns the packages a new version of the file at path may
+// declare: the package of src, and for a _test.go file also the external
+// test package or the package under test.
+func Packages(path, src string) []string {
+	pkg := PackageName(src)
+	if pkg == "" || !strings.HasSuffix(path, "_test.go") {
+		return []string{pkg}
+	}
+	pkg = strings.TrimSuffix(pkg, "_test")
+	return []string{pkg, pkg + "_test"}
+}
+
+// PackageName returns the package declared by src, or "" if it has no
+// readable package clause.
+func PackageName(src string) string {
+	file, err := parser.ParseFile(token.NewFileSet(), "", src, parser.PackageClauseOnly)
+	if err != nil {
+		return ""
+	}
+	return file.Name.Name
+}
@@ -0,0 +1,140 @@
+package utils
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const fileMain = "package main\n\nfunc main() {}"
+
+func TestExtractGoCode(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		pkgs     []string
+		want     string
+		wantErr  string
+	}{
+		{
+			name:     "go fence",
+			response: "Here you go:\n```go\n" + fileMain + "\n```\nDone.",
+			want:     fileMain,
+		},
+		{
+			name:     "golang fence",
+			response: "```golang\n" + fileMain + "\n```",
+			want:     fileMain,
+		},
+		{
+			name:     "unlabelled fence",
+			response: "```\n" + fileMain + "\n```",
+			want:     fileMain,
+		},
+		{
+			name:     "tilde fence",
+			response: "~~~go\n" + fileMain + "\n~~~",
+			want:     fileMain,
+		},
+		{
+			name:     "no fence",
+			response: fileMain + "\n",
+			want:     fileMain,
+		},
+		{
+			name:     "skips snippet and shell blocks",
+			response: "```go\nfunc main() {}\n```\n```bash\ngo run .\n```\n```go\n" + fileMain + "\n```",
+			want:     fileMain,
+		},
+		{
+			name:     "prefers the longer complete file",
+			response: "```go\npackage main\n```\n```go\n" + fileMain + "\n```",
+			want:     fileMain,
+		},
+		{
+			name:     "later block wins a tie",
+			response: "```go\npackage main\n\nfunc a() {}\n```\n```go\npackage main\n\nfunc b() {}\n```",
+			want:     "package main\n\nfunc b() {}",
+		},
+		{
+			name:     "truncated but complete file",
+			response: "```go\n" + fileMain + "\n",
+			want:     fileMain,
+		},
+		{
+			name:     "truncated inside a function",
+			response: "```go\npackage main\n\nfunc main() {\n\tprintln(",
+			wantErr:  "probably truncated",
+		},
+		{
+			name:     "wrong package",
+			response: "```go\npackage other\n```",
+			pkgs:     []string{"main"},
+			wantErr:  "declares package other, want main",
+		},
+		{
+			name:     "external test package",
+			response: "```go\npackage foo_test\n```",
+			pkgs:     Packages("foo_test.go", "package foo\n"),
+			want:     "package foo_test",
+		},
+		{
+			name:     "external test package for a non-test file",
+			response: "```go\npackage foo_test\n```",
+			pkgs:     Packages("foo.go", "package foo\n"),
+			wantErr:  "declares package foo_test, want foo",
+		},
+		{
+			name:     "expected package",
+			response: "```go\npackage other\n```\n```go\npackage main\n```",
+			pkgs:     []string{"main"},
+			want:     "package main",
+		},
+		{
+			name:     "prose only",
+			response: "I cannot help with that.",
+			wantErr:  "no code block",
+		},
+		{
+			name:     "other language",
+			response: "```python\nprint('hi')\n```",
+			wantErr:  "labelled python, not Go",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ExtractGoCode(tt.response, tt.pkgs...)
+			if tt.wantErr != "" {
+				if err == nil || !errors.Is(err, ErrNoCode) || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Code != tt.want+"\n" {
+				t.Errorf("code = %q, want %q", got.Code, tt.want+"\n")
+			}
+		})
+	}
+}
+
+func TestPackages(t *testing.T) {
+	tests := []struct {
+		path, src string
+		want      []string
+	}{
+		{"a.go", "package a\n", []string{"a"}},
+		{"a_test.go", "package a\n", []string{"a", "a_test"}},
+		{"a_test.go", "package a_test\n", []string{"a", "a_test"}},
+		{"a.go", "", []string{""}},
+	}
+	for _, tt := range tests {
+		if got := Packages(tt.path, tt.src); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Packages(%q, %q) = %q, want %q", tt.path, tt.src, got, tt.want)
+		}
+	}
+}
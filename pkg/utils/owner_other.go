@@ -0,0 +1,14 @@
+//go:build !unix
+
+package utils
+
+import (
+	"io/fs"
+	"os"
+)
+
+// chown is a no-op where files have no Unix owner.
+func chown(f *os.File, info fs.FileInfo) error { return nil }
+
+// syncDir is a no-op where directories cannot be synced.
+func syncDir(dir string) {}
@@ -1,27 +1,216 @@
 package utils
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/build/constraint"
+	"go/parser"
+	"go/token"
+	"io/fs"
 	"os"
-	"regexp"
+	"path/filepath"
+	"strconv"
 	"strings"
 )
 
-var (
-	codeBlockRe = regexp.MustCompile(`(?s)\x60\x60\x60go(.*?)\x60\x60\x60`)
-)
+var bom = []byte("\xef\xbb\xbf")
+
+// ErrBuildConstraints is returned by SafeWriteFile when the new content of
+// a Go file changes its build constraints or cgo preamble.
+var ErrBuildConstraints = errors.New("build constraints or cgo preamble changed")
 
+// SafeWriteFile atomically replaces path with content. When path exists, its
+// mode, owner, BOM, line endings and final newline carry over to content,
+// and a Go file may not change its //go:build and // +build lines or the
+// preamble of import "C". The data is synced to disk through a uniquely
+// named temporary file in the same directory, which is removed on failure.
+// Symlinks are followed so the link itself is kept.
 func SafeWriteFile(path, content string) error {
-	tmp := path + ".tmp"
-	if err := os.WriteFile(tmp, []byte(content), 0644); err != nil {
+	data := []byte(content)
+	old, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if strings.HasSuffix(path, ".go") {
+			if err := sameBuildHeader(old, data); err != nil {
+				return err
+			}
+		}
+		data = matchFormat(old, data)
+	case !errors.Is(err, fs.ErrNotExist):
+		return err
+	}
+	return ReplaceFile(path, data, 0)
+}
+
+// ReplaceFile atomically replaces path with data as it is, the way
+// SafeWriteFile does. A zero mode keeps the mode of an existing file and
+// uses 0644 for a new one; the owner of an existing file is kept either way.
+func ReplaceFile(path string, data []byte, mode fs.FileMode) error {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	info, err := os.Stat(path)
+	switch {
+	case err == nil:
+		if mode == 0 {
+			mode = info.Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+		}
+	case errors.Is(err, fs.ErrNotExist):
+		info = nil
+		if mode == 0 {
+			mode = 0644
+		}
+	default:
+		return err
+	}
+
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := os.CreateTemp(dir, "."+base+".*.tmp")
+	if err != nil {
 		return err
 	}
-	return os.Rename(tmp, path)
+	err = writeSynced(tmp, data, mode, info)
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+// writeSynced writes data to f, applies the mode and owner of the file it
+// replaces (info may be nil) and syncs and closes it.
+func writeSynced(f *os.File, data []byte, mode fs.FileMode, info fs.FileInfo) error {
+	_, err := f.Write(data)
+	if err == nil {
+		err = f.Chmod(mode)
+	}
+	if err == nil && info != nil {
+		err = chown(f, info)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
 
-func ExtractCodeBlock(response string) string {
-	matches := codeBlockRe.FindStringSubmatch(response)
-	if len(matches) > 1 {
-		return strings.TrimSpace(matches[1])
+// SameContent reports whether SafeWriteFile would leave a file holding old
+// unchanged when writing data, which differs from old at most in its BOM,
+// line endings and final newline.
+func SameContent(old, data []byte) bool {
+	return bytes.Equal(matchFormat(old, data), old)
+}
+
+// matchFormat gives data the BOM, line endings and final newline of old.
+func matchFormat(old, data []byte) []byte {
+	data = bytes.TrimPrefix(data, bom)
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+
+	oldBody := bytes.TrimPrefix(old, bom)
+	if len(oldBody) > 0 {
+		if bytes.HasSuffix(oldBody, []byte("\n")) {
+			if !bytes.HasSuffix(data, []byte("\n")) {
+				data = append(data, '\n')
+			}
+		} else {
+			data = bytes.TrimRight(data, "\n")
+		}
+	}
+	// Most lines ending in CRLF means a CRLF file.
+	if crlf := bytes.Count(old, []byte("\r\n")); crlf > 0 && 2*crlf >= bytes.Count(old, []byte("\n")) {
+		data = bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+	}
+	if bytes.HasPrefix(old, bom) {
+		data = append(append([]byte{}, bom...), data...)
+	}
+	return data
+}
+
+// sameBuildHeader reports an error wrapping ErrBuildConstraints if the build
+// constraints or cgo preamble of updated differ from those of old.
+func sameBuildHeader(old, updated []byte) error {
+	oldLines, newLines := buildConstraints(old), buildConstraints(updated)
+	if strings.Join(oldLines, "\n") != strings.Join(newLines, "\n") {
+		return fmt.Errorf("%w: constraints were %s, now %s", ErrBuildConstraints, describe(oldLines), describe(newLines))
+	}
+	oldPreamble, oldOK := cgoPreamble(old)
+	newPreamble, newOK := cgoPreamble(updated)
+	if oldOK && newOK && oldPreamble != newPreamble {
+		return fmt.Errorf("%w: the cgo preamble differs", ErrBuildConstraints)
+	}
+	return nil
+}
+
+func describe(lines []string) string {
+	if len(lines) == 0 {
+		return "none"
+	}
+	return strconv.Quote(strings.Join(lines, "; "))
+}
+
+// buildConstraints returns the //go:build and // +build lines that precede
+// the package clause of src, the way the go command reads them.
+func buildConstraints(src []byte) []string {
+	src = bytes.TrimPrefix(src, bom)
+	var lines []string
+	inBlock := false
+	for _, line := range strings.Split(string(src), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case inBlock:
+			if _, rest, ok := strings.Cut(line, "*/"); ok {
+				inBlock = false
+				if strings.TrimSpace(rest) != "" {
+					return lines
+				}
+			}
+		case line == "" || strings.HasPrefix(line, "//"):
+			if constraint.IsGoBuild(line) || constraint.IsPlusBuild(line) {
+				lines = append(lines, line)
+			}
+		case strings.HasPrefix(line, "/*"):
+			inBlock = !strings.Contains(line[2:], "*/")
+		default:
+			return lines
+		}
+	}
+	return lines
+}
+
+// cgoPreamble returns the comment above import "C" in src. It reports false
+// if src does not parse.
+func cgoPreamble(src []byte) (string, bool) {
+	file, err := parser.ParseFile(token.NewFileSet(), "", src, parser.ImportsOnly|parser.ParseComments)
+	if err != nil {
+		return "", false
+	}
+	for _, decl := range file.Decls {
+		d, ok := decl.(*ast.GenDecl)
+		if !ok || d.Tok != token.IMPORT {
+			continue
+		}
+		for _, spec := range d.Specs {
+			spec := spec.(*ast.ImportSpec)
+			if spec.Path.Value != `"C"` {
+				continue
+			}
+			doc := spec.Doc
+			if doc == nil && !d.Lparen.IsValid() {
+				doc = d.Doc
+			}
+			return doc.Text(), true
+		}
 	}
-	return response
+	return "", true
 }
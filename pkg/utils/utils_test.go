@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSafeWriteFilePreservesFormat(t *testing.T) {
+	tests := []struct {
+		name, old, content, want string
+	}{
+		{"new content as is", "", "package a\n", "package a\n"},
+		{"crlf", "package a\r\n\r\nvar x int\r\n", "package a\n\nvar y int\n", "package a\r\n\r\nvar y int\r\n"},
+		{"bom", "\xef\xbb\xbfpackage a\n", "package a\n\nvar y int\n", "\xef\xbb\xbfpackage a\n\nvar y int\n"},
+		{"no final newline", "package a", "package a\n\nvar y int\n\n", "package a\n\nvar y int"},
+		{"adds final newline", "package a\n", "package a", "package a\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "a.go")
+			if tt.old != "" {
+				if err := os.WriteFile(path, []byte(tt.old), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := SafeWriteFile(path, tt.content); err != nil {
+				t.Fatal(err)
+			}
+			got, _ := os.ReadFile(path)
+			if string(got) != tt.want {
+				t.Errorf("file = %q, want %q", got, tt.want)
+			}
+			entries, _ := os.ReadDir(filepath.Dir(path))
+			if len(entries) != 1 {
+				t.Errorf("directory holds %d entries, want only a.go", len(entries))
+			}
+		})
+	}
+}
+
+func TestSafeWriteFileKeepsMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run.sh")
+	if err := os.WriteFile(path, []byte("echo a\n"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := SafeWriteFile(path, "echo b\n"); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0750 {
+		t.Errorf("mode = %v, want 0750", info.Mode().Perm())
+	}
+}
+
+func TestSafeWriteFileBuildHeader(t *testing.T) {
+	const tagged = "//go:build linux\n\npackage a\n"
+	const cgo = "package a\n\n// #include <stdio.h>\nimport \"C\"\n"
+	tests := []struct {
+		name, old, content string
+		ok                 bool
+	}{
+		{"unchanged tags", tagged, tagged + "\nvar x int\n", true},
+		{"dropped tags", tagged, "package a\n", false},
+		{"changed tags", tagged, "//go:build darwin\n\npackage a\n", false},
+		{"added tags", "package a\n", tagged, false},
+		{"unchanged preamble", cgo, cgo + "\nvar x int\n", true},
+		{"changed preamble", cgo, "package a\n\n// #include <stdlib.h>\nimport \"C\"\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "a.go")
+			if err := os.WriteFile(path, []byte(tt.old), 0644); err != nil {
+				t.Fatal(err)
+			}
+			err := SafeWriteFile(path, tt.content)
+			if tt.ok != (err == nil) || (err != nil && !errors.Is(err, ErrBuildConstraints)) {
+				t.Fatalf("err = %v, want ok=%v", err, tt.ok)
+			}
+			got, _ := os.ReadFile(path)
+			if !tt.ok && string(got) != tt.old {
+				t.Errorf("refused write changed the file to %q", got)
+			}
+		})
+	}
+}